@@ -0,0 +1,93 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrNotCached is returned by reads made with a context from WithCacheOnly, for entities which
+// aren't in the cache. GetMulti returns it inside a datastore.MultiError, at the positions of the
+// entities which aren't cached.
+var ErrNotCached = errors.New("godscache: entity isn't cached")
+
+// ctxKeyCacheControl is a type for the context key used to control caching for a call.
+type ctxKeyCacheControl string
+
+// cacheControlKey is the context key for a call's cacheControl.
+const cacheControlKey = ctxKeyCacheControl("cacheControl")
+
+// cacheControl holds the caching settings for a call, set with the With* context helpers.
+type cacheControl struct {
+	noCache      bool
+	cacheOnly    bool
+	refresh      bool
+	maxStaleness time.Duration
+}
+
+// cacheControlFrom returns the caching settings in ctx.
+func cacheControlFrom(ctx context.Context) cacheControl {
+	cc, _ := ctx.Value(cacheControlKey).(cacheControl)
+	return cc
+}
+
+// withCacheControl returns a copy of ctx with the caching settings changed by f.
+func withCacheControl(ctx context.Context, f func(cc *cacheControl)) context.Context {
+	cc := cacheControlFrom(ctx)
+	f(&cc)
+
+	return context.WithValue(ctx, cacheControlKey, cc)
+}
+
+// WithNoCache returns a context which makes Client calls bypass the cache. Reads go straight to
+// the datastore and don't add what they read to the cache. Writes don't add what they write to
+// the cache, but they still delete the old entries from it, so it's never left out of date.
+func WithNoCache(ctx context.Context) context.Context {
+	return withCacheControl(ctx, func(cc *cacheControl) { cc.noCache = true })
+}
+
+// WithCacheOnly returns a context which makes Client reads only use the cache. Entities which
+// aren't cached aren't read from the datastore, and ErrNotCached is returned for them instead.
+// Writes can't be made with it, since they always have to go to the datastore, and queries
+// can't be run with it, since they aren't cached. RunStore returns an error for them, and Run
+// panics.
+func WithCacheOnly(ctx context.Context) context.Context {
+	return withCacheControl(ctx, func(cc *cacheControl) { cc.cacheOnly = true })
+}
+
+// WithRefresh returns a context which makes Client reads ignore what's in the cache, read the
+// datastore, and overwrite the cache with what they read. Writes made with it always write what
+// they write into the cache, whatever the write strategy.
+func WithRefresh(ctx context.Context) context.Context {
+	return withCacheControl(ctx, func(cc *cacheControl) { cc.refresh = true })
+}
+
+// WithMaxStaleness returns a context which makes Client reads ignore cached entities which were
+// cached more than d ago, and read them from the datastore instead. It overrides the MaxAge of
+// the Client and its KindPolicies.
+func WithMaxStaleness(ctx context.Context, d time.Duration) context.Context {
+	return withCacheControl(ctx, func(cc *cacheControl) { cc.maxStaleness = d })
+}
+
+// readsCache says whether reads should look in the cache.
+func (cc cacheControl) readsCache() bool {
+	return !cc.noCache && !cc.refresh
+}
+
+// errIterator is an Iterator which only returns an error.
+type errIterator struct {
+	err error
+}
+
+func (it errIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return nil, it.err
+}
+
+func (it errIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, it.err
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// DefaultMaxItemSize is the largest value in bytes which is stored in a single memcache item,
+// unless the Client's MaxItemSize says otherwise. It's a little less than memcached's default
+// item size limit of 1MiB, to leave room for the key and memcached's own overhead.
+const DefaultMaxItemSize = 1000 * 1000
+
+// flagChunked marks a manifest value, which says where to find the chunks of a value that was
+// too large to store in one memcache item. The value's own header is at the start of its first
+// chunk.
+const flagChunked byte = 1 << 1
+
+// chunkIDLen is the length in bytes of a chunk set ID.
+const chunkIDLen = 8
+
+// maxChunks is the most chunks a value can be split into. Manifests with more are invalid, so a
+// corrupt manifest can't make a reader fetch or allocate an unbounded number of chunks.
+const maxChunks = 1 << 16
+
+// chunkManifest describes a value which has been split into chunks. Each time a value is chunked,
+// its chunks get a new random ID, which is part of their keys. That way a reader can never mix
+// chunks from two different writes of the same entity.
+type chunkManifest struct {
+	id     [chunkIDLen]byte
+	chunks int
+	size   int
+}
+
+// chunkKeys returns the memcache keys of the chunks of the value stored under key.
+func (m *chunkManifest) chunkKeys(key string) []string {
+	keys := make([]string, 0, m.chunks)
+	for n := 0; n < m.chunks; n++ {
+		keys = append(keys, fmt.Sprintf("%v#chunk/%x/%v", key, m.id, n))
+	}
+
+	return keys
+}
+
+// encode returns the manifest as a value to store in the cache.
+func (m *chunkManifest) encode() []byte {
+	value := make([]byte, 0, valueHeaderLen+chunkIDLen+2*binary.MaxVarintLen64)
+	value = append(value, valueMagic, flagChunked)
+	value = append(value, m.id[:]...)
+	value = binary.AppendUvarint(value, uint64(m.chunks))
+	value = binary.AppendUvarint(value, uint64(m.size))
+
+	return value
+}
+
+// parseManifest returns the chunk manifest in value, or nil if value isn't a manifest.
+func parseManifest(value []byte) (*chunkManifest, error) {
+	if len(value) < valueHeaderLen || value[0] != valueMagic || value[1] != flagChunked {
+		return nil, nil
+	}
+
+	data := value[valueHeaderLen:]
+	if len(data) < chunkIDLen {
+		return nil, errors.New("godscache.parseManifest: chunk manifest is too short")
+	}
+
+	m := &chunkManifest{}
+	copy(m.id[:], data)
+	data = data[chunkIDLen:]
+
+	chunks, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("godscache.parseManifest: chunk manifest has an invalid chunk count")
+	}
+	data = data[n:]
+
+	if chunks == 0 || chunks > maxChunks {
+		return nil, fmt.Errorf("godscache.parseManifest: chunk manifest has an invalid chunk count: %v", chunks)
+	}
+
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("godscache.parseManifest: chunk manifest has an invalid size")
+	}
+	data = data[n:]
+
+	// Every chunk holds at least one byte of the value.
+	if size < chunks || size > math.MaxInt {
+		return nil, fmt.Errorf("godscache.parseManifest: chunk manifest has an invalid size: %v", size)
+	}
+
+	if len(data) != 0 {
+		return nil, errors.New("godscache.parseManifest: chunk manifest is too long")
+	}
+
+	m.chunks, m.size = int(chunks), int(size)
+
+	return m, nil
+}
+
+// cacheItems returns the memcache items to store value under key. If value is larger than the
+// client's MaxItemSize, it's split into chunks, and the items for the chunks come before the item
+// for the manifest. Setting them in order means a reader never finds a manifest whose chunks
+// haven't been stored yet.
+func (c *Client) cacheItems(key string, value []byte) ([]*memcache.Item, error) {
+	if c.MaxItemSize <= 0 || len(value) <= c.MaxItemSize {
+		return []*memcache.Item{{Key: key, Value: value}}, nil
+	}
+
+	m := &chunkManifest{
+		chunks: (len(value) + c.MaxItemSize - 1) / c.MaxItemSize,
+		size:   len(value),
+	}
+
+	if m.chunks > maxChunks {
+		return nil, fmt.Errorf("godscache.Client.cacheItems: value of %v bytes needs %v chunks, which is more than %v", len(value), m.chunks, maxChunks)
+	}
+
+	_, err := rand.Read(m.id[:])
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.cacheItems: failed making chunk set ID: %v", err)
+	}
+
+	items := make([]*memcache.Item, 0, m.chunks+1)
+	for n, chunkKey := range m.chunkKeys(key) {
+		end := (n + 1) * c.MaxItemSize
+		if end > len(value) {
+			end = len(value)
+		}
+
+		items = append(items, &memcache.Item{Key: chunkKey, Value: value[n*c.MaxItemSize : end]})
+	}
+
+	items = append(items, &memcache.Item{Key: key, Value: m.encode()})
+
+	return items, nil
+}
+
+// resolveChunks returns the values of the given memcache items, indexed by key. Items which are
+// chunk manifests are replaced with their reassembled values, fetching the chunks for all of them
+// in one multi-get. If any of a value's chunks are missing, the value is left out, so that it's
+// treated as a cache miss. Chunks which are left behind when a value is overwritten or deleted
+// aren't deleted, and are evicted by memcached like any other unused item.
+func (c *Client) resolveChunks(items map[string]*memcache.Item) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(items))
+	manifests := make(map[string]*chunkManifest)
+	chunkKeys := make([]string, 0)
+
+	for key, item := range items {
+		m, err := parseManifest(item.Value)
+		if err != nil {
+			log.Printf("godscache.Client.resolveChunks: ignoring invalid chunk manifest for %v: %v", key, err)
+			continue
+		}
+
+		if m == nil {
+			values[key] = item.Value
+			continue
+		}
+
+		manifests[key] = m
+		chunkKeys = append(chunkKeys, m.chunkKeys(key)...)
+	}
+
+	if len(manifests) == 0 {
+		return values, nil
+	}
+
+	// Get the chunks of every chunked value at once.
+	chunks, err := c.MemcacheClient.GetMulti(chunkKeys)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.resolveChunks: failed getting chunks from memcached: %v", err)
+	}
+
+	for key, m := range manifests {
+		keys := m.chunkKeys(key)
+
+		// The chunks' total length is checked before allocating the value, since the manifest's
+		// size can't be trusted to be the length of the value.
+		size := 0
+		for _, chunkKey := range keys {
+			chunk, ok := chunks[chunkKey]
+			if !ok {
+				size = -1
+				break
+			}
+
+			size += len(chunk.Value)
+		}
+
+		if size != m.size {
+			continue
+		}
+
+		value := make([]byte, 0, size)
+		for _, chunkKey := range keys {
+			value = append(value, chunks[chunkKey].Value...)
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
@@ -19,7 +19,18 @@
 // Things which aren't implemented in this library can be used anyway, they just won't be cached.
 // For example, the Client struct holds a Parent member which is the raw Google Datastore client,
 // so you can use that instead to make your requests if you need to use some feature that's not
-// implemented in godscache, or if you want to bypass the cache for some reason.
+// implemented in godscache, or if you want to bypass the cache for some reason. To control the
+// cache for a single call instead, pass it a context from WithNoCache, WithCacheOnly,
+// WithRefresh, or WithMaxStaleness. Entities which are read repeatedly while handling one
+// request can be kept in memory for the rest of it with WithRequestCache, or Middleware. Set
+// LocalCacheSize to keep entities in memory for longer, and use SetInvalidator to keep every
+// process's local cache up to date. Entities can be looked up by the value of a unique field,
+// such as an email address, with SetUniqueIndex and GetBy, and entities which refer to others
+// by their keys can be got along with them, with GetMultiWithRefs. Use Update to change an
+// entity in a transaction, rather than getting and putting it.
+//
+// The datastore itself is accessed through the Store interface. NewClient uses the Google Cloud
+// Datastore, but you can use NewClientWithStore to put godscache in front of any other Store.
 //
 // To use godscache, you will need a Google Cloud project with an initialized Datastore on it,
 // and a memcached instance to connect to. You can connect to as many memcached instances as you want.
@@ -27,11 +38,11 @@ package godscache
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -39,12 +50,17 @@ import (
 	"google.golang.org/api/option"
 )
 
-// Client is the main struct for godscache. It holds a regular datastore client in the
-// Parent field, as well as the memcache client.
+// Client is the main struct for godscache. It holds the Store it adds caching to, a regular
+// datastore client in the Parent field, as well as the memcache client.
 type Client struct {
 	// The raw Datastore client, which can be used directly if you want to bypass caching.
+	// It's nil if the Client was made with NewClientWithStore and a Store which isn't
+	// backed by the Google Cloud Datastore.
 	Parent *datastore.Client
 
+	// The datastore which godscache adds caching to. All datastore requests go through it.
+	Store Store
+
 	// The Google Cloud Platform project ID.
 	ProjectID string
 
@@ -53,11 +69,95 @@ type Client struct {
 
 	// The memcache client, which you can use directly if you want to access the cache.
 	MemcacheClient *memcache.Client
+
+	// Entities whose JSON encoding, in its envelope, is larger than this many bytes are
+	// compressed with snappy before they're encrypted or split into chunks. The compressed data is
+	// only cached if it's smaller, so data which doesn't compress is cached as it is. NewClient
+	// sets it to DefaultCompressionThreshold. Set it to 0 to try compressing everything, or to a
+	// negative number to turn compression off.
+	CompressionThreshold int
+
+	// Cached values larger than this many bytes are split into chunks, which are stored as
+	// separate memcache items. NewClient sets it to DefaultMaxItemSize. Set it to 0 or less to
+	// turn chunking off.
+	MaxItemSize int
+
+	// If this is set, cached values are encrypted with AES-GCM using the keys it provides, and
+	// cached values which aren't encrypted with one of its keys are ignored.
+	Encryption KeyProvider
+
+	// How the cache is updated when entities are written to the datastore, for kinds which
+	// don't have their own KindPolicy. The zero value is WriteThrough.
+	WriteStrategy WriteStrategy
+
+	// The longest time entities can be served from the cache after they were cached, for kinds
+	// which don't have their own KindPolicy. Older entities are read from the datastore again.
+	// If it's 0, entities can be served from the cache for as long as they're in it.
+	MaxAge time.Duration
+
+	// How long after entities are cached they're refreshed in the background when they're read,
+	// for kinds which don't have their own KindPolicy. Until their MaxAge, reads still get
+	// what's cached, without waiting for the datastore. If it's 0, entities aren't refreshed
+	// until they're older than their MaxAge.
+	SoftTTL time.Duration
+
+	// How long before their MaxAge entities are refreshed in the background when they're read,
+	// for kinds which don't have their own KindPolicy. If it's 0, entities aren't refreshed
+	// ahead of their MaxAge.
+	RefreshAhead time.Duration
+
+	// The most background refreshes which can run at once. NewClient sets it to
+	// DefaultRefreshWorkers. Set it to 0 or less to turn background refreshes off. Changing it
+	// after the client's first background refresh has no effect.
+	RefreshWorkers int
+
+	// How long tombstones for deleted entities are kept in the cache. While an entity's
+	// tombstone is cached, reads report that it doesn't exist, and reads which raced with the
+	// delete can't cache it again. NewClient sets it to DefaultTombstoneTTL, and it's rounded up
+	// to whole seconds. Set it to 0 or less to delete entities from the cache without
+	// tombstones.
+	TombstoneTTL time.Duration
+
+	// The most entities the client keeps in its local cache, in memory, in front of memcache.
+	// If it's 0 or less, which is the default, there's no local cache. Use SetInvalidator so
+	// that entities which other processes write or delete are forgotten from it.
+	LocalCacheSize int
+
+	// How long entities are kept in the local cache after they were cached. NewClient sets it
+	// to DefaultLocalCacheTTL. If it's 0 or less, they're kept until they're invalidated, or
+	// until there's no room for them.
+	LocalCacheTTL time.Duration
+
+	// Caching settings for particular kinds, set with SetKindPolicy.
+	policiesMu sync.RWMutex
+	policies   map[string]KindPolicy
+
+	// The unique fields of each kind, set with SetUniqueIndex.
+	uniqueMu      sync.RWMutex
+	uniqueIndexes map[string][]string
+
+	// Counts of what the cache has been doing.
+	stats clientStats
+
+	// The workers which refresh entities in the background.
+	refresher refresher
+
+	// The Memoize calls which are computing values.
+	flights flightGroup
+
+	// The local cache, and the ID the client publishes invalidations with.
+	local localCache
+	id    string
+
+	// The Invalidator set with SetInvalidator, and the function which unsubscribes from it.
+	invalidatorMu sync.Mutex
+	invalidator   Invalidator
+	unsubscribe   func()
 }
 
 // NewClient is a constructor for making a new godscache client. Start here. It makes a datastore
-// client and stores it in the Parent field, and it makes a memcache client. Set the context with
-// the MemcacheServerKey, with a value of
+// client and stores it in the Parent field, wrapped in the Store field, and it makes a memcache
+// client. Set the context with the MemcacheServerKey, with a value of
 // []string{"ip_address1:port", "ip_addressN:port"}, to specify which memcache servers to connect
 // to. Alternately you can set the environment variable
 // GODSCACHE_MEMCACHED_SERVERS="ip_address1:port,ip_addressN:port" instead to specify
@@ -70,6 +170,23 @@ func NewClient(ctx context.Context, projectID string, opts ...option.ClientOptio
 		return nil, err
 	}
 
+	return newClient(ctx, projectID, NewDatastoreStore(dsClient)), nil
+}
+
+// NewClientWithStore is a constructor for making a new godscache client which adds caching to
+// the given Store, instead of to a new Google Cloud Datastore client. The memcached servers are
+// specified the same way as for NewClient. The Parent field is only set if store was made with
+// NewDatastoreStore.
+func NewClientWithStore(ctx context.Context, projectID string, store Store) (*Client, error) {
+	if store == nil {
+		return nil, errors.New("godscache.NewClientWithStore: you provided a nil store")
+	}
+
+	return newClient(ctx, projectID, store), nil
+}
+
+// Make a new godscache client which uses the given store.
+func newClient(ctx context.Context, projectID string, store Store) *Client {
 	// Get the list of memcached servers to connect to.
 	memcacheServers := memcacheServers(ctx)
 
@@ -84,81 +201,203 @@ func NewClient(ctx context.Context, projectID string, opts ...option.ClientOptio
 
 	// Instantiate a new godscache Client and return a pointer to it.
 	c := &Client{
-		Parent:          dsClient,
-		ProjectID:       projectID,
-		MemcacheServers: memcacheServers,
-		MemcacheClient:  memcacheClient,
+		Store:                store,
+		ProjectID:            projectID,
+		MemcacheServers:      memcacheServers,
+		MemcacheClient:       memcacheClient,
+		CompressionThreshold: DefaultCompressionThreshold,
+		MaxItemSize:          DefaultMaxItemSize,
+		RefreshWorkers:       DefaultRefreshWorkers,
+		TombstoneTTL:         DefaultTombstoneTTL,
+		LocalCacheTTL:        DefaultLocalCacheTTL,
+		id:                   randomID(),
+	}
+
+	// Keep the raw datastore client available if there is one.
+	if dsStore, ok := store.(*datastoreStore); ok {
+		c.Parent = dsStore.client
 	}
 
-	return c, nil
+	return c
+}
+
+// Close stops the background refreshes and the use of the client's Invalidator, and closes the
+// connection to the datastore.
+func (c *Client) Close() error {
+	c.refresher.stop()
+	c.SetInvalidator(nil)
+
+	return c.Store.Close()
 }
 
 // Run a datastore query. To utilize this with caching, you should perform a KeysOnly() query,
-// and then use Get() on the keys.
+// and then use Get() on the keys. It runs the query with the Parent client, so it can't be used
+// with a Store which isn't backed by the Google Cloud Datastore. Use RunStore for those.
+//
+// A *datastore.Iterator can't be made to return an error of godscache's own, so Run panics if
+// the client has no Parent, or if ctx is from WithCacheOnly, which queries can't be run with.
+// RunStore returns an Iterator which reports those errors instead.
 func (c *Client) Run(ctx context.Context, q *datastore.Query) *datastore.Iterator {
+	if c.Parent == nil {
+		panic("godscache.Client.Run: the client has no Parent datastore client, so queries must be run with RunStore")
+	}
+
+	// Queries aren't cached, so they can't be answered from the cache alone.
+	if cacheControlFrom(ctx).cacheOnly {
+		panic("godscache.Client.Run: queries can't be run with WithCacheOnly")
+	}
+
 	// Perform the query using the datastore client.
 	return c.Parent.Run(ctx, q)
 }
 
-// Put data into the datastore and into the cache. The src value must be a Struct pointer.
+// RunStore runs a datastore query the same way as Run, but through the client's Store, so it
+// works with any Store. Queries can't be run with a context from WithCacheOnly, since they
+// aren't cached, so the iterator it returns only returns an error then.
+func (c *Client) RunStore(ctx context.Context, q *datastore.Query) Iterator {
+	// Queries aren't cached, so they can't be answered from the cache alone.
+	if cacheControlFrom(ctx).cacheOnly {
+		return errIterator{err: errors.New("godscache.Client.RunStore: queries can't be run with WithCacheOnly")}
+	}
+
+	// Perform the query using the store.
+	return c.Store.Run(ctx, q)
+}
+
+// Put data into the datastore and into the cache. The src value must be a Struct pointer, a
+// *datastore.PropertyList, or a datastore.PropertyLoadSaver.
 func (c *Client) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if cacheControlFrom(ctx).cacheOnly {
+		return nil, errors.New("godscache.Client.Put: writes can't be made with WithCacheOnly")
+	}
+
 	var err error
 
-	// Put data into the datastore.
-	key, err = c.Parent.Put(ctx, key, src)
+	// Put data into the datastore. If key is incomplete, it's replaced with the completed key,
+	// so the data is cached under that. Entities with unique fields are put in a transaction
+	// with the markers for their values.
+	var changes uniqueChanges
+	if c.hasUniqueFields([]*datastore.Key{key}) {
+		var keys []*datastore.Key
+		keys, changes, err = c.putUnique(ctx, []*datastore.Key{key}, []interface{}{src})
+		if err == nil {
+			key = keys[0]
+		}
+	} else {
+		key, err = c.Store.Put(ctx, key, src)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("godscache.Client.Put: failed putting src into datastore: %v", err)
+		return nil, fmt.Errorf("godscache.Client.Put: failed putting src into datastore: %w", err)
 	}
 
-	// Add data to cache.
-	err = c.addToCache(key, src)
+	// Add data to cache, or invalidate it.
+	err = c.writeCache(ctx, key, src)
 	if err != nil {
 		return nil, fmt.Errorf("godscache.Client.Put: failed adding item to cache: %v", err)
 	}
 
+	c.cacheUniqueChanges(ctx, changes)
+
+	c.publishInvalidation(ctx, []*datastore.Key{key})
+
+	err = c.invalidateKeyTags(ctx, []*datastore.Key{key})
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.Put: failed invalidating tags: %v", err)
+	}
+
 	return key, nil
 }
 
 // PutMulti adds multiple pieces of data to the datastore and cache all at once.
 // It returns a slice of complete keys.
 func (c *Client) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
-	// Put data into datastore.
-	ret, err := c.Parent.PutMulti(ctx, keys, src)
-	if err != nil {
-		return nil, fmt.Errorf("godscache.Client.PutMulti: failed putting multiple entries into datastore: %v", err)
+	if cacheControlFrom(ctx).cacheOnly {
+		return nil, errors.New("godscache.Client.PutMulti: writes can't be made with WithCacheOnly")
 	}
 
 	// Make a runtime value of the data.
 	sVal := reflect.ValueOf(src)
 
-	// Iterate over all the keys, adding the data to the cache.
-	for idx, key := range keys {
-		// Add data to the cache.
-		err = c.addToCache(key, sVal.Index(idx).Interface())
+	// Put data into datastore. Entities with unique fields are put in a transaction with the
+	// markers for their values.
+	var ret []*datastore.Key
+	var changes uniqueChanges
+	var err error
+	if c.hasUniqueFields(keys) {
+		if sVal.Kind() != reflect.Slice || sVal.Len() != len(keys) {
+			return nil, errors.New("godscache.Client.PutMulti: src must be a slice of the same length as keys")
+		}
+
+		srcs := make([]interface{}, len(keys))
+		for idx := range srcs {
+			elem := sVal.Index(idx)
+			if elem.Kind() == reflect.Interface || elem.Kind() == reflect.Ptr {
+				srcs[idx] = elem.Interface()
+			} else {
+				srcs[idx] = elem.Addr().Interface()
+			}
+		}
+
+		ret, changes, err = c.putUnique(ctx, keys, srcs)
+	} else {
+		ret, err = c.Store.PutMulti(ctx, keys, src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.PutMulti: failed putting multiple entries into datastore: %w", err)
+	}
+
+	// Iterate over all the completed keys, adding the data to the cache. Incomplete keys
+	// have been given IDs by the datastore, and the data must be cached under those.
+	for idx, key := range ret {
+		// Add data to the cache, or invalidate it.
+		err = c.writeCache(ctx, key, sVal.Index(idx).Interface())
 		if err != nil {
 			return nil, fmt.Errorf("godscache.Client.PutMulti: failed putting data into cache: %v", err)
 		}
 	}
 
+	c.cacheUniqueChanges(ctx, changes)
+
+	c.publishInvalidation(ctx, ret)
+
+	err = c.invalidateKeyTags(ctx, ret)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.PutMulti: failed invalidating tags: %v", err)
+	}
+
 	return ret, nil
 }
 
-// Get data from the datastore or cache. The dst value must be a Struct pointer.
+// Get data from the datastore or cache. The dst value must be a Struct pointer, a
+// *datastore.PropertyList, or a datastore.PropertyLoadSaver.
 func (c *Client) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
-	// Get data from the cache if it's in there.
-	cached := c.getFromCache(key, dst)
+	cc := cacheControlFrom(ctx)
+
+	// Get data from the cache if it's in there. If the entity was deleted, the cache says so.
+	cached := false
+	if cc.readsCache() {
+		var err error
+		cached, err = c.getFromCache(ctx, key, dst)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Check if the requested data wasn't found in the cache.
 	if !cached {
+		if cc.cacheOnly {
+			return ErrNotCached
+		}
+
 		// Get data from the datastore, and save it in dst.
-		err := c.Parent.Get(ctx, key, dst)
+		err := c.Store.Get(ctx, key, dst)
 		if err != nil {
 			return err
 		}
 
 		// Put data into the cache.
 		// log.Printf("godscache.Client.Get: cache MISS: %v", key)
-		err = c.addToCache(key, dst)
+		err = c.fillCache(ctx, key, dst)
 		if err != nil {
 			return fmt.Errorf("godscache.Client.Get: failed adding item to cache: %v", err)
 		}
@@ -170,8 +409,12 @@ func (c *Client) Get(ctx context.Context, key *datastore.Key, dst interface{}) e
 }
 
 // GetMulti is for getting multiple values from the datastore or cache.
-// The dst value must be a slice of structs or struct pointers, and not a datastore.PropertyList.
-// It must also be the same length as the keys slice.
+// The dst value must be a slice of structs, struct pointers, datastore.PropertyLists, or
+// datastore.PropertyLoadSavers, or a []interface{} of pointers to any of those. It must not be a
+// datastore.PropertyList itself, and it must be the same length as the keys slice.
+// If any of the entities can't be got, such as because they don't exist, a datastore.MultiError
+// is returned, with the error for each entity at the same position as its key, whether the
+// error came from the cache or the datastore.
 func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
 	// Get runtime value of dst.
 	dVal := reflect.ValueOf(dst)
@@ -197,12 +440,21 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 
 	// Make some new data structures to hold keys and results.
 	uncachedKeys := make([]*datastore.Key, 0)
+	uncachedIdxs := make([]int, 0)
 	resultsMap := make(map[string]interface{}, len(keys))
 
-	// Batch get items from cache.
-	err := c.getMultiFromCache(keys, dst)
-	if err != nil {
-		return fmt.Errorf("godscache.Client.GetMulti: failed getting multiple items from cache: %v", err)
+	cc := cacheControlFrom(ctx)
+
+	// Batch get items from cache. The errors for entities which the cache says were deleted are
+	// returned once the other entities have been got.
+	hits := make([]bool, len(keys))
+	var errs datastore.MultiError
+	if cc.readsCache() {
+		var err error
+		hits, errs, err = c.getMultiFromCache(ctx, keys, dst)
+		if err != nil {
+			return fmt.Errorf("godscache.Client.GetMulti: failed getting multiple items from cache: %v", err)
+		}
 	}
 
 	// log.Printf("godscache.Client.GetMulti: got multiple results from cache: %+v", dst)
@@ -210,16 +462,28 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 	// For each key.
 	for idx, key := range keys {
 		// Check if we're missing the value because it wasn't in the cache.
-		dVal2 := dVal.Index(idx)
-		if (dVal2.Kind() == reflect.Ptr && dVal2.IsNil()) || dVal2.Kind() == reflect.Struct {
+		if !hits[idx] {
 			// Add the key to the list of uncached keys, so we can use it below to request the Datastore.
 			uncachedKeys = append(uncachedKeys, key)
+			uncachedIdxs = append(uncachedIdxs, idx)
 		} else {
 			// If the value was in the cache, add it to the results map.
-			resultsMap[key.String()] = dVal2.Interface()
+			resultsMap[cacheKey(key)] = dVal.Index(idx).Interface()
 		}
 	}
 
+	// If only the cache may be used, report the uncached keys as errors.
+	if cc.cacheOnly && len(uncachedKeys) > 0 {
+		if errs == nil {
+			errs = make(datastore.MultiError, len(keys))
+		}
+		for _, idx := range uncachedIdxs {
+			errs[idx] = ErrNotCached
+		}
+
+		return errs
+	}
+
 	// If there are any uncached keys, use them for a batch datastore lookup.
 	if len(uncachedKeys) > 0 {
 		// log.Printf("godscache.Client.GetMulti: number of cache misses: %v", len(uncachedKeys))
@@ -232,11 +496,19 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 		dsResults := reflect.New(dstType).Elem()
 		dsResults.Set(dsResultsSlice)
 
+		// The elements of a []interface{} must be the pointers the datastore loads into.
+		if dstType.Elem().Kind() == reflect.Interface {
+			for idx, dstIdx := range uncachedIdxs {
+				dsResults.Index(idx).Set(dVal.Index(dstIdx))
+			}
+		}
+
 		// log.Printf("godscache.Client.GetMulti: dsResults type: %v", dsResults.Type().String())
 
 		// Get the uncached data from the datastore.
-		err := c.Parent.GetMulti(ctx, uncachedKeys, dsResults.Interface())
-		if err != nil {
+		err := c.Store.GetMulti(ctx, uncachedKeys, dsResults.Interface())
+		dsErrs, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
 			return fmt.Errorf("godscache.Client.GetMulti: failed getting multiple values from datastore: %v", err)
 		}
 
@@ -244,12 +516,22 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 
 		// Add the data to the results map, and to the cache.
 		for idx, key := range uncachedKeys {
-			keyStr := key.String()
+			keyStr := cacheKey(key)
 
 			res := dsResults.Index(idx).Interface()
 			resultsMap[keyStr] = res
 
-			err = c.addToCache(key, res)
+			// Entities which couldn't be got aren't cached, and their errors are returned at
+			// the positions of their keys.
+			if dsErrs != nil && dsErrs[idx] != nil {
+				if errs == nil {
+					errs = make(datastore.MultiError, len(keys))
+				}
+				errs[uncachedIdxs[idx]] = dsErrs[idx]
+				continue
+			}
+
+			err = c.fillCache(ctx, key, res)
 			if err != nil {
 				return fmt.Errorf("godscache.Client.GetMulti: failed adding item to cache: %v", err)
 			}
@@ -258,7 +540,7 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 
 	// Copy the results to dst in the correct order.
 	for idx, key := range keys {
-		keyStr := key.String()
+		keyStr := cacheKey(key)
 		val, ok := resultsMap[keyStr]
 		if !ok {
 			return fmt.Errorf("godscache.Client.GetMulti: expected item not found in results map")
@@ -268,6 +550,10 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 
 	// log.Printf("godscache.Client.GetMulti: results: %+v", dst)
 
+	if errs != nil {
+		return errs
+	}
+
 	return nil
 }
 
@@ -277,16 +563,44 @@ func (c *Client) Delete(ctx context.Context, key *datastore.Key) error {
 		return fmt.Errorf("godscache.Client.Delete: failed deleting item from cache and datastore: you provided a nil key")
 	}
 
-	// Delete the data from the cache, if it's in there.
-	err := c.deleteFromCache(key)
+	if cacheControlFrom(ctx).cacheOnly {
+		return errors.New("godscache.Client.Delete: writes can't be made with WithCacheOnly")
+	}
+
+	// Replace the data in the cache with a tombstone first, so that reads which race with the
+	// delete can't cache it again.
+	err := c.tombstoneCache([]*datastore.Key{key})
 	if err != nil {
 		return fmt.Errorf("godscache.Client.Delete: failed deleting item from cache: %v", err)
 	}
+	c.deleteFromMemory(ctx, []*datastore.Key{key}, true)
 
-	// Delete data from datastore.
-	err = c.Parent.Delete(ctx, key)
+	// Delete data from datastore. Entities with unique fields are deleted in a transaction with
+	// the markers for their values.
+	var changes uniqueChanges
+	if c.hasUniqueFields([]*datastore.Key{key}) {
+		changes, err = c.deleteUnique(ctx, []*datastore.Key{key})
+	} else {
+		err = c.Store.Delete(ctx, key)
+	}
+	if err != nil {
+		// The entity may still exist, so it mustn't be hidden by its tombstone.
+		c.deleteFromMemory(ctx, []*datastore.Key{key}, false)
+		cacheErr := c.deleteFromCache(key)
+		if cacheErr != nil {
+			log.Printf("godscache.Client.Delete: failed deleting tombstone from cache: %v", cacheErr)
+		}
+
+		return fmt.Errorf("godscache.Client.Delete: failed deleting item from datastore: %v", err)
+	}
+
+	c.cacheUniqueChanges(ctx, changes)
+
+	c.publishInvalidation(ctx, []*datastore.Key{key})
+
+	err = c.invalidateKeyTags(ctx, []*datastore.Key{key})
 	if err != nil {
-		return fmt.Errorf("godscache.Client.Parent.Delete: failed deleting item from datastore: %v", err)
+		return fmt.Errorf("godscache.Client.Delete: failed invalidating tags: %v", err)
 	}
 
 	return nil
@@ -294,125 +608,475 @@ func (c *Client) Delete(ctx context.Context, key *datastore.Key) error {
 
 // DeleteMulti deletes multiple pieces of data from the datastore and cache all at once.
 func (c *Client) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
-	// Put data into datastore.
-	err := c.Parent.DeleteMulti(ctx, keys)
+	if cacheControlFrom(ctx).cacheOnly {
+		return errors.New("godscache.Client.DeleteMulti: writes can't be made with WithCacheOnly")
+	}
+
+	// Replace the data in the cache with tombstones first, the same way Delete does.
+	err := c.tombstoneCache(keys)
 	if err != nil {
-		return fmt.Errorf("godscache.Client.DeleteMulti: failed deleting multiple entries from datastore: %v", err)
+		return fmt.Errorf("godscache.Client.DeleteMulti: failed deleting data from cache: %v", err)
 	}
+	c.deleteFromMemory(ctx, keys, true)
 
-	// Iterate over all the keys, deleting the data from the cache.
-	for _, key := range keys {
-		// Delete data from the cache.
-		err = c.deleteFromCache(key)
-		if err != nil {
-			return fmt.Errorf("godscache.Client.DeleteMulti: failed deleting data from cache: %v", err)
+	// Delete data from datastore, the same way Delete does.
+	var changes uniqueChanges
+	if c.hasUniqueFields(keys) {
+		changes, err = c.deleteUnique(ctx, keys)
+	} else {
+		err = c.Store.DeleteMulti(ctx, keys)
+	}
+	if err != nil {
+		// Some of the entities may still exist, so they mustn't be hidden by their tombstones.
+		c.deleteFromMemory(ctx, keys, false)
+		for _, key := range keys {
+			cacheErr := c.deleteFromCache(key)
+			if cacheErr != nil {
+				log.Printf("godscache.Client.DeleteMulti: failed deleting tombstone from cache: %v", cacheErr)
+			}
 		}
+
+		return fmt.Errorf("godscache.Client.DeleteMulti: failed deleting multiple entries from datastore: %v", err)
+	}
+
+	c.cacheUniqueChanges(ctx, changes)
+
+	c.publishInvalidation(ctx, keys)
+
+	err = c.invalidateKeyTags(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.DeleteMulti: failed invalidating tags: %v", err)
 	}
 
 	return nil
 }
 
-// Add an item to the cache.
-func (c *Client) addToCache(key *datastore.Key, data interface{}) error {
-	if c.MemcacheClient != nil {
-		// Convert data to JSON bytes.
-		dataBytes, err := json.Marshal(data)
-		if err != nil {
-			return fmt.Errorf("godscache.Client.addToCache: failed marshaling data to JSON: %v", err)
+// Mutate applies mutations made with NewInsert, NewUpdate, NewUpsert and NewDelete to the
+// datastore atomically, and returns the keys of the entities they affected, in the same order
+// as the mutations, with the keys given to inserted entities in place of incomplete ones. The
+// entities being deleted are replaced with tombstones in the cache first, the same way as with
+// DeleteMulti, and the entities which were written are removed from the cache once the
+// mutations are applied, so that they're read from the datastore again. Mutations don't say
+// what they write, so entities of kinds with unique fields can't be written with Mutate, since
+// the markers for their values can't be updated.
+//
+// Unlike datastore.Client.Mutate, it takes godscache Mutations rather than datastore.Mutations,
+// since a datastore.Mutation doesn't say which key it affects, or whether it's a delete, and
+// those are needed before the mutations are applied, to cache tombstones for the deletes and to
+// reject kinds with unique fields.
+func (c *Client) Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Key, error) {
+	if cacheControlFrom(ctx).cacheOnly {
+		return nil, errors.New("godscache.Client.Mutate: writes can't be made with WithCacheOnly")
+	}
+
+	dsMuts := make([]*datastore.Mutation, len(muts))
+	mutKeys := make([]*datastore.Key, len(muts))
+	var deletes []*datastore.Key
+	for idx, mut := range muts {
+		if mut == nil {
+			return nil, fmt.Errorf("godscache.Client.Mutate: mutation %v is nil", idx)
+		}
+
+		dsMuts[idx], mutKeys[idx] = mut.mut, mut.key
+		if mut.delete && mut.key != nil {
+			deletes = append(deletes, mut.key)
 		}
+	}
+
+	if c.hasUniqueFields(mutKeys) {
+		return nil, errors.New("godscache.Client.Mutate: entities of kinds with unique fields can't be written with Mutate")
+	}
+
+	// Replace the entities being deleted with tombstones first, so that reads which race with
+	// the mutations can't cache them again.
+	err := c.tombstoneCache(deletes)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.Mutate: failed deleting data from cache: %v", err)
+	}
+	c.deleteFromMemory(ctx, deletes, true)
+
+	keys, err := c.Store.Mutate(ctx, dsMuts...)
+	if err != nil {
+		// None of the mutations were applied, so the entities mustn't be hidden by their
+		// tombstones.
+		c.deleteFromMemory(ctx, deletes, false)
+		for _, key := range deletes {
+			cacheErr := c.deleteFromCache(key)
+			if cacheErr != nil {
+				log.Printf("godscache.Client.Mutate: failed deleting tombstone from cache: %v", cacheErr)
+			}
+		}
+
+		return nil, fmt.Errorf("godscache.Client.Mutate: failed applying mutations to datastore: %v", err)
+	}
+
+	written := make([]*datastore.Key, 0, len(keys))
+	for idx, key := range keys {
+		if !muts[idx].delete {
+			written = append(written, key)
+		}
+	}
 
-		// Add JSON bytes to memcached server(s), indexed by the string representation of
-		// the datastore key.
-		err = c.MemcacheClient.Set(
-			&memcache.Item{
-				Key:   key.String(),
-				Value: dataBytes,
-			},
-		)
+	c.deleteFromMemory(ctx, written, false)
+
+	for _, key := range written {
+		err = c.deleteFromCache(key)
 		if err != nil {
-			return fmt.Errorf("godscache.Client.addToCache: failed adding item to cache: %v", err)
+			return nil, fmt.Errorf("godscache.Client.Mutate: failed deleting data from cache: %v", err)
 		}
 	}
 
+	c.publishInvalidation(ctx, keys)
+
+	err = c.invalidateKeyTags(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.Mutate: failed invalidating tags: %v", err)
+	}
+
+	return keys, nil
+}
+
+// Update the cache after writing data to the datastore, according to the write strategy for
+// the key's kind, and the caching settings in ctx.
+func (c *Client) writeCache(ctx context.Context, key *datastore.Key, data interface{}) error {
+	cc := cacheControlFrom(ctx)
+
+	if cc.noCache || (!cc.refresh && c.writeStrategy(key.Kind) == InvalidateOnWrite) {
+		c.deleteFromMemory(ctx, []*datastore.Key{key}, false)
+		return c.deleteFromCache(key)
+	}
+
+	c.addToMemory(ctx, key, data, false)
+
+	_, err := c.addToCache(key, data, storeSet)
+
+	return err
+}
+
+// Add data which was read from the datastore to the cache. With the InvalidateOnWrite
+// strategy, it's only added if the key isn't cached already, unless ctx is from WithRefresh,
+// or there's a maximum staleness, in which case what's cached may be too stale and must be
+// replaced. Tombstones are never replaced, since the data may have been read before the
+// entity was deleted. The data is only kept in memory if it was stored in memcache, so that
+// it isn't kept after a delete which raced with the read.
+// Nothing is added if ctx is from WithNoCache.
+func (c *Client) fillCache(ctx context.Context, key *datastore.Key, data interface{}) error {
+	cc := cacheControlFrom(ctx)
+
+	if cc.noCache {
+		return nil
+	}
+
+	mode := storeReplace
+	if !cc.refresh && c.maxStaleness(ctx, key.Kind) == 0 && c.writeStrategy(key.Kind) == InvalidateOnWrite {
+		mode = storeAdd
+	}
+
+	stored, err := c.addToCache(key, data, mode)
+	if err != nil {
+		return err
+	}
+
+	if stored {
+		c.addToMemory(ctx, key, data, true)
+	}
+
 	return nil
 }
 
-// Get data from the cache, if it's in there. Returns true if there is a cache hit,
-// and if so, it populates dst with the data. If there is a cache miss, dst is left
-// untouched.
-func (c *Client) getFromCache(key *datastore.Key, dst interface{}) bool {
+// maxCacheKeyLen is the longest cacheKey which isn't hashed, leaving room under memcache's 250
+// byte limit for the suffixes of chunk keys.
+const maxCacheKeyLen = 200
+
+// hashedCacheKeyPrefix is the prefix of the cacheKeys which are hashed.
+const hashedCacheKeyPrefix = "godscache:key:"
+
+// cacheKey returns the key an entity is cached under, in memcache and in memory. Unlike
+// key.String(), it includes the key's namespace, and it's always a valid memcache key, whatever
+// the key's names contain.
+func cacheKey(key *datastore.Key) string {
+	keyStr := key.Encode()
+	if len(keyStr) > maxCacheKeyLen {
+		return hashedKey(hashedCacheKeyPrefix, keyStr)
+	}
+
+	return keyStr
+}
+
+// Add an item to the cache, storing it according to mode. It returns true if it was stored,
+// or if there's no memcache to store it in.
+func (c *Client) addToCache(key *datastore.Key, data interface{}, mode storeMode) (bool, error) {
 	if c.MemcacheClient == nil {
-		return false
+		return true, nil
+	}
+
+	// Convert data to JSON bytes.
+	dataBytes, err := marshalEntity(data)
+	if err != nil {
+		return false, fmt.Errorf("godscache.Client.addToCache: failed marshaling data to JSON: %v", err)
+	}
+
+	// Add JSON bytes to memcached server(s), indexed by the cache key of
+	// the datastore key. They're compressed first if they're large, and split into
+	// chunks if they're still too large for one item.
+	keyStr := cacheKey(key)
+
+	t := reflect.TypeOf(data)
+
+	value, err := c.encodeValue(keyStr, t, dataBytes)
+	if err != nil {
+		return false, fmt.Errorf("godscache.Client.addToCache: failed encoding data: %v", err)
+	}
+
+	items, err := c.cacheItems(keyStr, value)
+	if err != nil {
+		return false, fmt.Errorf("godscache.Client.addToCache: failed making cache items: %v", err)
 	}
 
+	// The last item is the one stored under the key. Any before it are chunks, which
+	// have keys of their own.
+	stored := false
+	for idx, item := range items {
+		if idx == len(items)-1 {
+			stored, err = c.storeItem(item, t, mode)
+		} else {
+			err = c.MemcacheClient.Set(item)
+		}
+		if err != nil {
+			return false, fmt.Errorf("godscache.Client.addToCache: failed adding item to cache: %v", err)
+		}
+	}
+
+	return stored, nil
+}
+
+// Get data from the cache, if it's in there. Returns true if there is a cache hit,
+// and if so, it populates dst with the data. If there is a cache miss, dst is left
+// untouched. If a tombstone is cached for the key, it returns datastore.ErrNoSuchEntity.
+func (c *Client) getFromCache(ctx context.Context, key *datastore.Key, dst interface{}) (bool, error) {
 	// Make sure dst is the right type.
 	if dst == nil || reflect.ValueOf(dst).Kind() != reflect.Ptr {
-		return false
+		return false, nil
+	}
+
+	// Check the request and local caches first. Data is decoded into a new value, so dst is untouched if
+	// it can't be decoded.
+	dVal := reflect.New(reflect.TypeOf(dst).Elem())
+	found, err := c.getFromMemory(ctx, key, dVal.Interface())
+	if found {
+		reflect.ValueOf(dst).Elem().Set(dVal.Elem())
+	}
+	if found || err != nil {
+		return found, err
+	}
+
+	if c.MemcacheClient == nil {
+		return false, nil
 	}
 
 	// Try to get data from memcache server(s), and return false if the data isn't in there.
-	item, err := c.MemcacheClient.Get(key.String())
+	keyStr := cacheKey(key)
+	item, err := c.MemcacheClient.Get(keyStr)
 	if err == memcache.ErrCacheMiss {
-		return false
+		c.stats.misses.Add(1)
+		return false, nil
 	}
 	if err != nil {
 		log.Printf("godscache.Client.getFromCache: failed getting data from memcached: %v", err)
-		return false
+		c.stats.misses.Add(1)
+		return false, nil
 	}
 
-	// Load data into dst.
-	err = json.Unmarshal(item.Value, dst)
+	// Reassemble the data if it was split into chunks.
+	values, err := c.resolveChunks(map[string]*memcache.Item{keyStr: item})
 	if err != nil {
-		log.Printf("godscache.Client.getFromCache: failed unmarshaling JSON data from cache: %v", err)
+		log.Printf("godscache.Client.getFromCache: failed getting data chunks from memcached: %v", err)
+		c.stats.misses.Add(1)
+		return false, nil
 	}
 
-	return true
+	value, ok := values[keyStr]
+	if !ok {
+		c.stats.misses.Add(1)
+		return false, nil
+	}
+
+	if isTombstone(value) {
+		c.stats.hits.Add(1)
+		return false, datastore.ErrNoSuchEntity
+	}
+
+	// Decode the data into a new value, so dst is untouched if it can't be decoded.
+	if !c.decodeCached(ctx, key, value, dVal.Interface()) {
+		return false, nil
+	}
+
+	reflect.ValueOf(dst).Elem().Set(dVal.Elem())
+
+	return true, nil
 }
 
-// Batch get data from the cache. The dst value must be a slice of pointers to structs,
-// and must be the same length as the keys slice. The dst value will be populated with
-// data if found in the cache, and nil for keys which aren't cached, in the order
-// of the keys slice.
-func (c *Client) getMultiFromCache(keys []*datastore.Key, dst interface{}) error {
-	if c.MemcacheClient == nil {
-		return nil
+// Batch get data from the cache. The dst value must be a slice of structs or pointers to
+// structs, and must be the same length as the keys slice. The dst value will be populated
+// with data if found in the cache, in the order of the keys slice. The returned slice says
+// which keys were found in the cache, and the positions in dst for the other keys are left
+// untouched. Keys which have tombstones cached are found, and the returned MultiError has
+// datastore.ErrNoSuchEntity at their positions. It's nil if there aren't any.
+func (c *Client) getMultiFromCache(ctx context.Context, keys []*datastore.Key, dst interface{}) ([]bool, datastore.MultiError, error) {
+	hits := make([]bool, len(keys))
+	var errs datastore.MultiError
+
+	// Get the runtime value of dst, and the type of its elements.
+	dVal := reflect.ValueOf(dst)
+	elemType := reflect.TypeOf(dst).Elem()
+
+	// Find the values to decode into. The elements of a []interface{} are pointers to them.
+	targets := make([]reflect.Value, len(keys))
+	targetTypes := make([]reflect.Type, len(keys))
+	for idx := range keys {
+		target, targetType := dVal.Index(idx), elemType
+		if elemType.Kind() == reflect.Interface {
+			target = target.Elem()
+			if target.Kind() != reflect.Ptr || target.IsNil() {
+				continue
+			}
+
+			target, targetType = target.Elem(), target.Type().Elem()
+		}
+
+		targets[idx], targetTypes[idx] = target, targetType
 	}
 
-	// Make the key strings slice, for use with memcache's get multi function.
+	// Get what's in the request and local caches first, and make the key strings slice for the rest, for
+	// use with memcache's get multi function.
 	keyStrs := make([]string, 0, len(keys))
-	for _, key := range keys {
-		keyStrs = append(keyStrs, key.String())
+	for idx, key := range keys {
+		if targetTypes[idx] == nil {
+			continue
+		}
+
+		dVal2 := reflect.New(targetTypes[idx])
+		found, err := c.getFromMemory(ctx, key, dVal2.Interface())
+		if err != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[idx] = err
+			hits[idx] = true
+			continue
+		}
+		if found {
+			targets[idx].Set(dVal2.Elem())
+			hits[idx] = true
+			continue
+		}
+
+		keyStrs = append(keyStrs, cacheKey(key))
+	}
+
+	if c.MemcacheClient == nil || len(keyStrs) == 0 {
+		return hits, errs, nil
 	}
 
 	// Batch get the data from memcached.
 	items, err := c.MemcacheClient.GetMulti(keyStrs)
 	if err != nil {
-		return fmt.Errorf("godscache.Client.getMultiFromCache: failed getting multiple items from memcached: %v", err)
+		return nil, nil, fmt.Errorf("godscache.Client.getMultiFromCache: failed getting multiple items from memcached: %v", err)
 	}
 
-	// Get the runtime value of dst.
-	dVal := reflect.ValueOf(dst)
+	// Reassemble any data which was split into chunks.
+	values, err := c.resolveChunks(items)
+	if err != nil {
+		return nil, nil, fmt.Errorf("godscache.Client.getMultiFromCache: failed getting data chunks from memcached: %v", err)
+	}
 
 	// Insert the data into dst. It will skip inserting in positions where data wasn't found
-	// in the cache, leaving those spots nil.
+	// in the cache.
 	for idx, key := range keys {
+		if hits[idx] {
+			continue
+		}
+
 		// Check if data is cached, and if so, get it out of the cache.
-		keyStr := key.String()
-		item, cached := items[keyStr]
-		if cached {
-			// Create a new runtime value which can be unmarshalled into.
-			dVal2 := reflect.New(reflect.TypeOf(dst).Elem())
-			err = json.Unmarshal(item.Value, dVal2.Interface())
-			if err != nil {
-				return fmt.Errorf("godscache.Client.getMultiFromCache: failed unmarshaling cached data from JSON: %v", err)
+		value, cached := values[cacheKey(key)]
+		if !cached || targetTypes[idx] == nil {
+			c.stats.misses.Add(1)
+			continue
+		}
+
+		if isTombstone(value) {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
 			}
+			errs[idx] = datastore.ErrNoSuchEntity
+			c.stats.hits.Add(1)
+			hits[idx] = true
+			continue
+		}
 
-			// Copy the data into dst.
-			dVal.Index(idx).Set(dVal2.Elem())
+		// Create a new runtime value which can be decoded into.
+		dVal2 := reflect.New(targetTypes[idx])
+		if !c.decodeCached(ctx, key, value, dVal2.Interface()) {
+			continue
 		}
+
+		// Copy the data into dst.
+		targets[idx].Set(dVal2.Elem())
+		hits[idx] = true
 	}
 
-	return nil
+	return hits, errs, nil
+}
+
+// decodeCached decodes a value from the cache under key into dst, which must be a pointer,
+// and counts the hit or miss. It returns false if the value can't be used, so it must be
+// treated as a cache miss. Values which were cached from a different type, or which were
+// cached longer ago than the maximum staleness allowed for the key, are left to be replaced with
+// fresh data from the datastore. Values which can't be decrypted or decoded are deleted from
+// the cache. Values which are due to be refreshed are used, and refreshed in the background.
+func (c *Client) decodeCached(ctx context.Context, key *datastore.Key, value []byte, dst interface{}) bool {
+	e, err := c.decodeValue(cacheKey(key), reflect.TypeOf(dst), value)
+	if errors.Is(err, errSchemaMismatch) {
+		c.stats.misses.Add(1)
+		return false
+	}
+
+	var age time.Duration
+	if err == nil {
+		age = time.Since(e.written)
+	}
+
+	if maxStaleness := c.maxStaleness(ctx, key.Kind); err == nil && maxStaleness > 0 && age > maxStaleness {
+		c.stats.misses.Add(1)
+		return false
+	}
+	if err == nil {
+		err = unmarshalEntity(key, e.data, dst)
+	}
+	if err != nil {
+		log.Printf("godscache.Client.decodeCached: deleting corrupt data for %v from cache: %v", key, err)
+		c.stats.misses.Add(1)
+		c.stats.corruptEntries.Add(1)
+
+		err = c.deleteFromCache(key)
+		if err != nil {
+			log.Printf("godscache.Client.decodeCached: failed deleting corrupt data from cache: %v", err)
+		}
+
+		return false
+	}
+
+	// Reads which may only use the cache mustn't cause datastore reads, even in the background.
+	if refreshAfter := c.refreshAfter(ctx, key.Kind); refreshAfter > 0 && age > refreshAfter && !cacheControlFrom(ctx).cacheOnly {
+		c.scheduleRefresh(ctx, key, reflect.TypeOf(dst).Elem())
+	}
+
+	// Keep the data in memory for reading again.
+	c.addEncodedToMemory(ctx, key, reflect.TypeOf(dst), e.data, e.written, true)
+
+	c.stats.hits.Add(1)
+
+	return true
 }
 
 // Delete data from cache.
@@ -422,7 +1086,7 @@ func (c *Client) deleteFromCache(key *datastore.Key) error {
 	}
 
 	// Delete data from memcached server(s).
-	err := c.MemcacheClient.Delete(key.String())
+	err := c.MemcacheClient.Delete(cacheKey(key))
 	if err == memcache.ErrCacheMiss {
 		return nil
 	}
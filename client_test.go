@@ -3,19 +3,41 @@
 
 // This is the test suite for godscache.Client.
 //
-// Set the environment variable GODSCACHE_PROJECT_ID to your Google Cloud Platform project ID before running these tests.
-// It must be set to a valid GCP project ID of a project that you control, with an initialized datastore.
+// By default the tests run offline, against the in-memory datastore and memcached fakes from the
+// godscachetest package.
+//
+// To run them against the gcloud Datastore emulator instead, start it and set the environment
+// variable DATASTORE_EMULATOR_HOST to its address. The tests will use a memcached server on
+// localhost:11211, unless GODSCACHE_MEMCACHED_SERVERS says otherwise, and the emulator and
+// memcached are reset between tests.
+//
+// To run them against a real datastore, set the environment variable GODSCACHE_PROJECT_ID
+// to your Google Cloud Platform project ID, and GODSCACHE_MEMCACHED_SERVERS to your memcached
+// servers, before running these tests. The project must be a valid GCP project that you control,
+// with an initialized datastore.
 package godscache
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/defcronyke/godscache/godscachetest"
 	"google.golang.org/api/iterator"
 )
 
@@ -29,27 +51,129 @@ type TestDbDataDifferent struct {
 	TestInt int
 }
 
+type TestDbDataLarge struct {
+	TestBytes []byte `datastore:",noindex"`
+}
+
 // ----- Main -----
 
 func TestMain(m *testing.M) {
 	ctx := context.Background()
 
+	// Run against the datastore emulator and a local memcached server, if the emulator is running.
+	if EmulatorHost() != "" {
+		setupEmulator()
+		os.Exit(runTests(ctx, m))
+	}
+
+	// Run offline against in-process fakes if no GCP project was specified.
+	if os.Getenv("GODSCACHE_PROJECT_ID") == "" {
+		stop, err := startFakes()
+		if err != nil {
+			log.Printf("godscache.TestMain: starting offline datastore and memcached fakes failed: %v", err)
+			os.Exit(3)
+		}
+
+		res := runTests(ctx, m)
+		stop()
+		os.Exit(res)
+	}
+
+	os.Exit(runTests(ctx, m))
+}
+
+// runTests clears the cache and runs the tests, returning the exit code.
+func runTests(ctx context.Context, m *testing.M) int {
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
 	if err != nil {
 		log.Printf("godscache.TestMain: instantiating new Client struct with a valid GCP project ID failed: %v", err)
-		os.Exit(1)
+		return 1
 	}
 
 	if c.MemcacheClient != nil {
 		err = c.MemcacheClient.DeleteAll()
 		if err != nil {
 			log.Printf("godscache.TestMain: deleting all data from memcache failed: %v", err)
-			os.Exit(2)
+			return 2
+		}
+	}
+
+	return m.Run()
+}
+
+// setupEmulator sets the environment variables used by the tests to defaults suitable for the
+// datastore emulator, if they aren't already set.
+func setupEmulator() {
+	if os.Getenv("GODSCACHE_PROJECT_ID") == "" {
+		projectID := os.Getenv("DATASTORE_PROJECT_ID")
+		if projectID == "" {
+			projectID = DefaultEmulatorProjectID
 		}
+		os.Setenv("GODSCACHE_PROJECT_ID", projectID)
+	}
+
+	if os.Getenv("GODSCACHE_MEMCACHED_SERVERS") == "" {
+		os.Setenv("GODSCACHE_MEMCACHED_SERVERS", DefaultEmulatorMemcacheServer)
+	}
+}
+
+// getCached gets data from the client's cache only, failing the test if the cache says it was
+// deleted.
+func getCached(t *testing.T, c *Client, key *datastore.Key, dst interface{}) bool {
+	cached, err := c.getFromCache(context.Background(), key, dst)
+	if err != nil {
+		t.Fatalf("godscache.getCached: failed getting data from cache: %v", err)
+	}
+
+	return cached
+}
+
+// resetEmulator deletes all data from the datastore and cache before a test, when the tests are
+// running against the datastore emulator or the offline fakes. Against a real datastore it does
+// nothing, and the tests clean up after themselves instead.
+func resetEmulator(t *testing.T) {
+	if EmulatorHost() == "" {
+		return
+	}
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.resetEmulator: instantiating new Client struct failed: %v", err)
+	}
+	defer c.Close()
+
+	err = c.ResetEmulator(ctx)
+	if err != nil {
+		t.Fatalf("godscache.resetEmulator: failed resetting the datastore emulator: %v", err)
+	}
+}
+
+// startFakes starts an in-memory datastore and memcached server, and points the environment
+// variables used by the tests at them. It returns a function which stops them again.
+func startFakes() (func(), error) {
+	ds, err := godscachetest.NewDatastore("godscache")
+	if err != nil {
+		return nil, err
+	}
+
+	mc, err := godscachetest.NewMemcached()
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+
+	os.Setenv("GODSCACHE_PROJECT_ID", ds.ProjectID())
+	os.Setenv("DATASTORE_EMULATOR_HOST", ds.Addr())
+	os.Setenv("GODSCACHE_MEMCACHED_SERVERS", mc.Addr())
+
+	stop := func() {
+		mc.Close()
+		ds.Close()
 	}
 
-	res := m.Run()
-	os.Exit(res)
+	return stop, nil
 }
 
 // ----- End Main -----
@@ -110,6 +234,191 @@ func TestNewClientNoMemcached(t *testing.T) {
 	}
 }
 
+// recordingStore is a Store which counts the requests passing through it.
+type recordingStore struct {
+	Store
+	gets      int
+	getMultis int
+	puts      int
+}
+
+func (s *recordingStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	s.gets++
+	return s.Store.Get(ctx, key, dst)
+}
+
+func (s *recordingStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	s.getMultis++
+	return s.Store.GetMulti(ctx, keys, dst)
+}
+
+func (s *recordingStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	s.puts++
+	return s.Store.Put(ctx, key, src)
+}
+
+// panics says whether f panics.
+func panics(f func()) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+
+	f()
+
+	return false
+}
+
+func TestNewClientWithStore(t *testing.T) {
+	ctx := context.Background()
+
+	dsClient, err := datastore.NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestNewClientWithStore: instantiating new datastore client failed: %v", err)
+	}
+
+	store := &recordingStore{Store: NewDatastoreStore(dsClient)}
+
+	c, err := NewClientWithStore(ctx, os.Getenv("GODSCACHE_PROJECT_ID"), store)
+	if err != nil {
+		t.Fatalf("godscache.TestNewClientWithStore: instantiating new Client struct with a custom store failed: %v", err)
+	}
+	defer c.Close()
+
+	if c.Parent != nil {
+		t.Fatalf("godscache.TestNewClientWithStore: Parent was set for a store not made by NewDatastoreStore")
+	}
+
+	if !panics(func() { c.Run(ctx, datastore.NewQuery("testNewClientWithStore")) }) {
+		t.Fatalf("godscache.TestNewClientWithStore: Run didn't panic without a Parent")
+	}
+
+	key := datastore.IncompleteKey("testNewClientWithStore", nil)
+	key, err = c.Put(ctx, key, &TestDbData{TestString: "TestNewClientWithStore"})
+	if err != nil {
+		t.Fatalf("godscache.TestNewClientWithStore: failed putting data into datastore and cache: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestNewClientWithStore: failed getting data from datastore or cache: %v", err)
+	}
+
+	if store.puts != 1 {
+		t.Fatalf("godscache.TestNewClientWithStore: expected 1 put through the store, got %v", store.puts)
+	}
+
+	if c.MemcacheClient != nil && store.gets != 0 {
+		t.Fatalf("godscache.TestNewClientWithStore: expected a cached get not to reach the store, got %v gets", store.gets)
+	}
+
+	err = c.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestNewClientWithStore: failed deleting test data from datastore and cache: %v", err)
+	}
+}
+
+func TestNewClientWithStoreNil(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := NewClientWithStore(ctx, os.Getenv("GODSCACHE_PROJECT_ID"), nil)
+	if err == nil {
+		t.Fatalf("godscache.TestNewClientWithStoreNil: instantiating new Client struct with a nil store succeeded.")
+	}
+}
+
+func TestNewClientStoreParent(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestNewClientStoreParent: instantiating new Client struct failed: %v", err)
+	}
+
+	if c.Parent == nil || c.Store == nil {
+		t.Fatalf("godscache.TestNewClientStoreParent: expected both Parent and Store to be set")
+	}
+}
+
+func TestNewEmulatorClient(t *testing.T) {
+	if EmulatorHost() == "" {
+		t.Skip("godscache.TestNewEmulatorClient: not running against the datastore emulator")
+	}
+
+	ctx := context.Background()
+
+	c, err := NewEmulatorClient(ctx, "")
+	if err != nil {
+		t.Fatalf("godscache.TestNewEmulatorClient: instantiating new Client struct for the emulator failed: %v", err)
+	}
+	defer c.Close()
+
+	if len(c.MemcacheServers) == 0 {
+		t.Fatalf("godscache.TestNewEmulatorClient: expected the emulator client to use a memcached server")
+	}
+}
+
+func TestNewEmulatorClientNotEmulated(t *testing.T) {
+	emulatorHost := EmulatorHost()
+	os.Unsetenv("DATASTORE_EMULATOR_HOST")
+	defer os.Setenv("DATASTORE_EMULATOR_HOST", emulatorHost)
+
+	ctx := context.Background()
+
+	_, err := NewEmulatorClient(ctx, "")
+	if err == nil {
+		t.Fatalf("godscache.TestNewEmulatorClientNotEmulated: instantiating new emulator Client struct without an emulator succeeded.")
+	}
+}
+
+func TestResetEmulator(t *testing.T) {
+	if EmulatorHost() == "" {
+		t.Skip("godscache.TestResetEmulator: not running against the datastore emulator")
+	}
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestResetEmulator: instantiating new Client struct failed: %v", err)
+	}
+
+	key := datastore.IncompleteKey("testResetEmulator", nil)
+	key, err = c.Put(ctx, key, &TestDbData{TestString: "TestResetEmulator"})
+	if err != nil {
+		t.Fatalf("godscache.TestResetEmulator: failed putting data into datastore and cache: %v", err)
+	}
+
+	err = c.ResetEmulator(ctx)
+	if err != nil {
+		t.Fatalf("godscache.TestResetEmulator: failed resetting the datastore emulator: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestResetEmulator: expected %v getting data after a reset, got %v", datastore.ErrNoSuchEntity, err)
+	}
+}
+
+func TestResetEmulatorNotEmulated(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestResetEmulatorNotEmulated: instantiating new Client struct failed: %v", err)
+	}
+
+	emulatorHost := EmulatorHost()
+	os.Unsetenv("DATASTORE_EMULATOR_HOST")
+	defer os.Setenv("DATASTORE_EMULATOR_HOST", emulatorHost)
+
+	err = c.ResetEmulator(ctx)
+	if err == nil {
+		t.Fatalf("godscache.TestResetEmulatorNotEmulated: succeeded resetting without the datastore emulator.")
+	}
+}
+
 func TestRun(t *testing.T) {
 	ctx := context.Background()
 
@@ -196,6 +505,8 @@ func TestRunKeysOnlyCached(t *testing.T) {
 }
 
 func TestPutSuccess(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -218,6 +529,8 @@ func TestPutSuccess(t *testing.T) {
 }
 
 func TestPutSuccessNoServers(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	servers := os.Getenv("GODSCACHE_MEMCACHED_SERVERS")
@@ -246,6 +559,8 @@ func TestPutSuccessNoServers(t *testing.T) {
 }
 
 func TestPutFailInvalidSrcType(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -267,6 +582,8 @@ func TestPutFailInvalidSrcType(t *testing.T) {
 }
 
 func TestPutFailInvalidCacheServer(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	memcacheServers := os.Getenv("GODSCACHE_MEMCACHED_SERVERS")
@@ -293,6 +610,8 @@ func TestPutFailInvalidCacheServer(t *testing.T) {
 }
 
 func TestPutMultiSuccess2(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -325,6 +644,8 @@ func TestPutMultiSuccess2(t *testing.T) {
 }
 
 func TestPutMultiFail2(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -355,6 +676,8 @@ func TestPutMultiFail2(t *testing.T) {
 }
 
 func TestPutMultiFailInvalidCacheServers2(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	memcacheServers := os.Getenv("GODSCACHE_MEMCACHED_SERVERS")
@@ -391,6 +714,8 @@ func TestPutMultiFailInvalidCacheServers2(t *testing.T) {
 }
 
 func TestGetSuccessUncached(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -420,6 +745,8 @@ func TestGetSuccessUncached(t *testing.T) {
 }
 
 func TestGetSuccessCached(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -449,6 +776,8 @@ func TestGetSuccessCached(t *testing.T) {
 }
 
 func TestGetFailInvalidDstTypeUncached(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -478,6 +807,8 @@ func TestGetFailInvalidDstTypeUncached(t *testing.T) {
 }
 
 func TestGetFailInvalidDstTypeCached(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -507,6 +838,8 @@ func TestGetFailInvalidDstTypeCached(t *testing.T) {
 }
 
 func TestGetFailUncachedInvalidCacheServers(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -544,6 +877,8 @@ func TestGetFailUncachedInvalidCacheServers(t *testing.T) {
 }
 
 func TestGetMultiSuccess(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -610,6 +945,8 @@ func TestGetMultiSuccess(t *testing.T) {
 }
 
 func TestGetMultiSuccessUncached(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -676,6 +1013,8 @@ func TestGetMultiSuccessUncached(t *testing.T) {
 }
 
 func TestGetMultiSuccessCachedAndUncached(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -744,6 +1083,8 @@ func TestGetMultiSuccessCachedAndUncached(t *testing.T) {
 }
 
 func TestGetMultiFail(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -813,6 +1154,8 @@ func TestGetMultiFail(t *testing.T) {
 }
 
 func TestGetMultiFailDatastoreRequest(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -876,6 +1219,8 @@ func TestGetMultiFailDatastoreRequest(t *testing.T) {
 }
 
 func TestDeleteFailNilKey(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -890,6 +1235,8 @@ func TestDeleteFailNilKey(t *testing.T) {
 }
 
 func TestDeleteFailIncompleteKey(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -906,6 +1253,8 @@ func TestDeleteFailIncompleteKey(t *testing.T) {
 }
 
 func TestDeleteMultiSuccess2(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -951,6 +1300,8 @@ func TestDeleteMultiSuccess2(t *testing.T) {
 }
 
 func TestDeleteMultiFail2(t *testing.T) {
+	resetEmulator(t)
+
 	ctx := context.Background()
 
 	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
@@ -1009,6 +1360,3152 @@ func TestDeleteMultiFail2(t *testing.T) {
 	}
 }
 
+func TestPutCompressed(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestPutCompressed: no memcached servers were specified")
+	}
+
+	// Keep the string short enough for the datastore to index it.
+	c.CompressionThreshold = 64
+
+	str := strings.Repeat("TestPutCompressed ", 20)
+	src := &TestDbData{TestString: str}
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testCompression", nil), src)
+	if err != nil {
+		t.Fatalf("godscache.TestPutCompressed: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	item, err := c.MemcacheClient.Get(cacheKey(key))
+	if err != nil {
+		t.Fatalf("godscache.TestPutCompressed: failed getting raw item from memcached: %v", err)
+	}
+
+	if len(item.Value) < valueHeaderLen || item.Value[0] != valueMagic || item.Value[1]&flagCompressed == 0 {
+		t.Fatalf("godscache.TestPutCompressed: large cached value wasn't marked as compressed")
+	}
+
+	if len(item.Value) >= len(str) {
+		t.Fatalf("godscache.TestPutCompressed: compressed value is %v bytes, which isn't smaller than the %v byte string", len(item.Value), len(str))
+	}
+
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestPutCompressed: failed getting data from cache: %v", err)
+	}
+
+	if dst.TestString != str {
+		t.Fatalf("godscache.TestPutCompressed: got the wrong data back from the cache")
+	}
+}
+
+func TestPutCompressionDisabled(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestPutCompressionDisabled: no memcached servers were specified")
+	}
+
+	c.CompressionThreshold = -1
+
+	src := &TestDbData{TestString: strings.Repeat("TestPutCompressionDisabled ", 50)}
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testCompression", nil), src)
+	if err != nil {
+		t.Fatalf("godscache.TestPutCompressionDisabled: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	item, err := c.MemcacheClient.Get(cacheKey(key))
+	if err != nil {
+		t.Fatalf("godscache.TestPutCompressionDisabled: failed getting raw item from memcached: %v", err)
+	}
+
+	if len(item.Value) < valueHeaderLen || item.Value[0] != valueMagic || item.Value[1]&flagCompressed != 0 {
+		t.Fatalf("godscache.TestPutCompressionDisabled: cached value was compressed with compression turned off")
+	}
+}
+
+func TestGetMultiMissingEntity(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	str := "TestGetMultiMissingEntity"
+
+	key, err := c.Parent.Put(ctx, datastore.IncompleteKey("testGetMulti", nil), &TestDbData{TestString: str})
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiMissingEntity: failed putting data into datastore: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	keys := []*datastore.Key{datastore.IDKey("testGetMulti", 1, nil), key}
+
+	// Neither entity is cached, and the datastore's error for the missing one is returned at
+	// its position.
+	for _, name := range []string{"uncached", "cached"} {
+		dsts := make([]*TestDbData, len(keys))
+		err = c.GetMulti(ctx, keys, dsts)
+
+		errs, ok := err.(datastore.MultiError)
+		if !ok {
+			t.Fatalf("godscache.TestGetMultiMissingEntity: %v: expected a datastore.MultiError, got: %v", name, err)
+		}
+
+		if errs[0] != datastore.ErrNoSuchEntity || errs[1] != nil {
+			t.Fatalf("godscache.TestGetMultiMissingEntity: %v: got the wrong errors: %v", name, errs)
+		}
+
+		if dsts[1] == nil || dsts[1].TestString != str {
+			t.Fatalf("godscache.TestGetMultiMissingEntity: %v: the entity which exists wasn't got", name)
+		}
+	}
+}
+
+func TestGetMultiMixedCompression(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetMultiMixedCompression: no memcached servers were specified")
+	}
+
+	c.CompressionThreshold = 64
+
+	kind := "testCompression"
+	strs := []string{
+		strings.Repeat("TestGetMultiMixedCompression compressed ", 10),
+		"TestGetMultiMixedCompression uncompressed",
+		"TestGetMultiMixedCompression legacy",
+	}
+
+	keys := make([]*datastore.Key, 0, len(strs))
+	for _, str := range strs {
+		key, err := c.Put(ctx, datastore.IncompleteKey(kind, nil), &TestDbData{TestString: str})
+		if err != nil {
+			t.Fatalf("godscache.TestGetMultiMixedCompression: failed putting data into datastore and cache: %v", err)
+		}
+		defer c.Delete(ctx, key)
+
+		keys = append(keys, key)
+	}
+
+	// Overwrite the last item the way older versions of godscache cached it, as plain JSON with
+	// no envelope. It can't be trusted, so it must be refreshed from the datastore.
+	err = c.MemcacheClient.Set(&memcache.Item{
+		Key:   cacheKey(keys[2]),
+		Value: []byte(`{"TestString":"TestGetMultiMixedCompression stale"}`),
+	})
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiMixedCompression: failed putting legacy item into memcached: %v", err)
+	}
+
+	// Make sure the other items are read from the cache.
+	err = c.Store.DeleteMulti(ctx, keys[:2])
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiMixedCompression: failed deleting data from datastore: %v", err)
+	}
+
+	dst := make([]*TestDbData, len(keys))
+
+	err = c.GetMulti(ctx, keys, dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiMixedCompression: failed getting data from cache: %v", err)
+	}
+
+	for idx, str := range strs {
+		if dst[idx] == nil || dst[idx].TestString != str {
+			t.Fatalf("godscache.TestGetMultiMixedCompression: got the wrong data back from the cache for item %v", idx)
+		}
+	}
+
+	// The legacy item was replaced in the cache with the data from the datastore.
+	err = c.Store.Delete(ctx, keys[2])
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiMixedCompression: failed deleting data from datastore: %v", err)
+	}
+
+	var refreshed TestDbData
+	err = c.Get(ctx, keys[2], &refreshed)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiMixedCompression: failed getting refreshed legacy item from cache: %v", err)
+	}
+
+	if refreshed.TestString != strs[2] {
+		t.Fatalf("godscache.TestGetMultiMixedCompression: got the wrong data back from the cache for the refreshed legacy item")
+	}
+}
+
+func TestPutChunkedLargeEntity(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestPutChunkedLargeEntity: no memcached servers were specified")
+	}
+
+	// Random data doesn't compress, and its JSON encoding is larger than a memcache item.
+	src := &TestDbDataLarge{TestBytes: make([]byte, 900*1000)}
+	_, err = rand.Read(src.TestBytes)
+	if err != nil {
+		t.Fatalf("godscache.TestPutChunkedLargeEntity: failed making random data: %v", err)
+	}
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testChunked", nil), src)
+	if err != nil {
+		t.Fatalf("godscache.TestPutChunkedLargeEntity: failed putting large entity into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	// Make sure the entity is read from the cache.
+	err = c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestPutChunkedLargeEntity: failed deleting data from datastore: %v", err)
+	}
+
+	var dst TestDbDataLarge
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestPutChunkedLargeEntity: failed getting large entity from cache: %v", err)
+	}
+
+	if !bytes.Equal(dst.TestBytes, src.TestBytes) {
+		t.Fatalf("godscache.TestPutChunkedLargeEntity: got the wrong data back from the cache")
+	}
+}
+
+func TestGetMultiChunked(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetMultiChunked: no memcached servers were specified")
+	}
+
+	c.CompressionThreshold = -1
+	c.MaxItemSize = 64
+
+	strs := []string{
+		strings.Repeat("TestGetMultiChunked 1 ", 20),
+		"TestGetMultiChunked 2",
+		strings.Repeat("TestGetMultiChunked 3 ", 30),
+	}
+
+	keys := make([]*datastore.Key, 0, len(strs))
+	for _, str := range strs {
+		key, err := c.Put(ctx, datastore.IncompleteKey("testChunked", nil), &TestDbData{TestString: str})
+		if err != nil {
+			t.Fatalf("godscache.TestGetMultiChunked: failed putting data into datastore and cache: %v", err)
+		}
+		defer c.Delete(ctx, key)
+
+		keys = append(keys, key)
+	}
+
+	item, err := c.MemcacheClient.Get(cacheKey(keys[0]))
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiChunked: failed getting raw item from memcached: %v", err)
+	}
+
+	m, err := parseManifest(item.Value)
+	if err != nil || m == nil || m.chunks < 2 {
+		t.Fatalf("godscache.TestGetMultiChunked: large cached value wasn't split into chunks")
+	}
+
+	// Make sure the items are all read from the cache.
+	err = c.Store.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiChunked: failed deleting data from datastore: %v", err)
+	}
+
+	dst := make([]*TestDbData, len(keys))
+
+	err = c.GetMulti(ctx, keys, dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiChunked: failed getting data from cache: %v", err)
+	}
+
+	for idx, str := range strs {
+		if dst[idx] == nil || dst[idx].TestString != str {
+			t.Fatalf("godscache.TestGetMultiChunked: got the wrong data back from the cache for item %v", idx)
+		}
+	}
+}
+
+func TestGetChunkMissing(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetChunkMissing: no memcached servers were specified")
+	}
+
+	c.CompressionThreshold = -1
+	c.MaxItemSize = 64
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testChunked", nil), &TestDbData{TestString: strings.Repeat("TestGetChunkMissing ", 20)})
+	if err != nil {
+		t.Fatalf("godscache.TestGetChunkMissing: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	item, err := c.MemcacheClient.Get(cacheKey(key))
+	if err != nil {
+		t.Fatalf("godscache.TestGetChunkMissing: failed getting raw item from memcached: %v", err)
+	}
+
+	m, err := parseManifest(item.Value)
+	if err != nil || m == nil {
+		t.Fatalf("godscache.TestGetChunkMissing: large cached value wasn't split into chunks")
+	}
+
+	err = c.MemcacheClient.Delete(m.chunkKeys(cacheKey(key))[1])
+	if err != nil {
+		t.Fatalf("godscache.TestGetChunkMissing: failed deleting chunk from memcached: %v", err)
+	}
+
+	// With a chunk missing, the entity must be looked up in the datastore, where it's gone.
+	err = c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestGetChunkMissing: failed deleting data from datastore: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestGetChunkMissing: expected a cache miss and datastore.ErrNoSuchEntity, got: %v", err)
+	}
+
+	dsts := make([]*TestDbData, 1)
+	err = c.GetMulti(ctx, []*datastore.Key{key}, dsts)
+	if err == nil {
+		t.Fatalf("godscache.TestGetChunkMissing: GetMulti treated an entity with a missing chunk as cached")
+	}
+}
+
+func TestGetCorruptManifest(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetCorruptManifest: no memcached servers were specified")
+	}
+
+	src := &TestDbData{TestString: "TestGetCorruptManifest"}
+	key, err := c.Put(ctx, datastore.IncompleteKey("testChunked", nil), src)
+	if err != nil {
+		t.Fatalf("godscache.TestGetCorruptManifest: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	manifest := func(chunks, size uint64) []byte {
+		value := append([]byte{valueMagic, flagChunked}, make([]byte, chunkIDLen)...)
+		value = binary.AppendUvarint(value, chunks)
+		return binary.AppendUvarint(value, size)
+	}
+
+	// A manifest whose chunks are all there, but add up to less than its size.
+	short := &chunkManifest{chunks: 2, size: 10}
+	for _, chunkKey := range short.chunkKeys(cacheKey(key)) {
+		err = c.MemcacheClient.Set(&memcache.Item{Key: chunkKey, Value: []byte("abc")})
+		if err != nil {
+			t.Fatalf("godscache.TestGetCorruptManifest: failed setting chunk in memcached: %v", err)
+		}
+	}
+
+	corrupt := map[string][]byte{
+		"huge chunk count": manifest(1<<62, 1<<63),
+		"zero chunk count": manifest(0, 10),
+		"size too small":   manifest(3, 2),
+		"size mismatch":    short.encode(),
+		"trailing data":    append(manifest(2, 10), 0),
+	}
+
+	for name, value := range corrupt {
+		err = c.MemcacheClient.Set(&memcache.Item{Key: cacheKey(key), Value: value})
+		if err != nil {
+			t.Fatalf("godscache.TestGetCorruptManifest: %v: failed setting raw item in memcached: %v", name, err)
+		}
+
+		// An invalid manifest is a cache miss, so the entity is read from the datastore.
+		var dst TestDbData
+		err = c.Get(ctx, key, &dst)
+		if err != nil {
+			t.Fatalf("godscache.TestGetCorruptManifest: %v: failed getting data: %v", name, err)
+		}
+		if dst.TestString != src.TestString {
+			t.Fatalf("godscache.TestGetCorruptManifest: %v: got %q, expected %q", name, dst.TestString, src.TestString)
+		}
+
+		err = c.MemcacheClient.Set(&memcache.Item{Key: cacheKey(key), Value: value})
+		if err != nil {
+			t.Fatalf("godscache.TestGetCorruptManifest: %v: failed setting raw item in memcached: %v", name, err)
+		}
+
+		dsts := make([]*TestDbData, 1)
+		err = c.GetMulti(ctx, []*datastore.Key{key}, dsts)
+		if err != nil {
+			t.Fatalf("godscache.TestGetCorruptManifest: %v: failed getting multiple values: %v", name, err)
+		}
+		if dsts[0].TestString != src.TestString {
+			t.Fatalf("godscache.TestGetCorruptManifest: %v: GetMulti got %q, expected %q", name, dsts[0].TestString, src.TestString)
+		}
+	}
+}
+
+// newEncryptedTestClient makes a client which encrypts cached values with a key provider holding
+// the given key IDs, and using the first of them as the current key.
+func newEncryptedTestClient(t *testing.T, ids ...string) *Client {
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.newEncryptedTestClient: no memcached servers were specified")
+	}
+
+	keys := make(map[string][]byte, len(ids))
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id), 32)[:32]
+	}
+
+	c.Encryption, err = NewStaticKeyProvider(ids[0], keys)
+	if err != nil {
+		t.Fatalf("godscache.newEncryptedTestClient: failed making key provider: %v", err)
+	}
+
+	return c
+}
+
+func TestNewStaticKeyProviderInvalid(t *testing.T) {
+	_, err := NewStaticKeyProvider("a", map[string][]byte{"a": make([]byte, 10)})
+	if err == nil {
+		t.Fatalf("godscache.TestNewStaticKeyProviderInvalid: made a key provider with a 10 byte key")
+	}
+
+	_, err = NewStaticKeyProvider("b", map[string][]byte{"a": make([]byte, 16)})
+	if err == nil {
+		t.Fatalf("godscache.TestNewStaticKeyProviderInvalid: made a key provider with a missing current key")
+	}
+}
+
+func TestPutEncrypted(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newEncryptedTestClient(t, "key1")
+
+	str := "TestPutEncrypted"
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testEncrypted", nil), &TestDbData{TestString: str})
+	if err != nil {
+		t.Fatalf("godscache.TestPutEncrypted: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	item, err := c.MemcacheClient.Get(cacheKey(key))
+	if err != nil {
+		t.Fatalf("godscache.TestPutEncrypted: failed getting raw item from memcached: %v", err)
+	}
+
+	if item.Value[1]&flagEncrypted == 0 || bytes.Contains(item.Value, []byte(str)) {
+		t.Fatalf("godscache.TestPutEncrypted: cached value wasn't encrypted")
+	}
+
+	// Make sure the entity is read from the cache.
+	err = c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestPutEncrypted: failed deleting data from datastore: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestPutEncrypted: failed getting data from cache: %v", err)
+	}
+
+	if dst.TestString != str {
+		t.Fatalf("godscache.TestPutEncrypted: got the wrong data back from the cache")
+	}
+}
+
+func TestGetEncryptedKeyRotation(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newEncryptedTestClient(t, "key1")
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testEncrypted", nil), &TestDbData{TestString: "TestGetEncryptedKeyRotation"})
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedKeyRotation: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	err = c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedKeyRotation: failed deleting data from datastore: %v", err)
+	}
+
+	// Rotate to a new key, keeping the old one for decrypting.
+	rotated := newEncryptedTestClient(t, "key2", "key1")
+
+	dst := make([]*TestDbData, 1)
+	err = rotated.GetMulti(ctx, []*datastore.Key{key}, dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedKeyRotation: failed getting data encrypted with the old key from cache: %v", err)
+	}
+
+	// Once the old key is retired, the data can't be decrypted, so it's a cache miss.
+	retired := newEncryptedTestClient(t, "key2")
+
+	var dst2 TestDbData
+	err = retired.Get(ctx, key, &dst2)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestGetEncryptedKeyRotation: expected a cache miss and datastore.ErrNoSuchEntity, got: %v", err)
+	}
+
+	_, err = c.MemcacheClient.Get(cacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestGetEncryptedKeyRotation: data which couldn't be decrypted wasn't evicted from the cache")
+	}
+}
+
+func TestGetEncryptedTampered(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newEncryptedTestClient(t, "key1")
+
+	str := "TestGetEncryptedTampered"
+
+	keys := make([]*datastore.Key, 0, 2)
+	for i := 0; i < 2; i++ {
+		key, err := c.Put(ctx, datastore.IncompleteKey("testEncrypted", nil), &TestDbData{TestString: str})
+		if err != nil {
+			t.Fatalf("godscache.TestGetEncryptedTampered: failed putting data into datastore and cache: %v", err)
+		}
+		defer c.Delete(ctx, key)
+
+		keys = append(keys, key)
+	}
+
+	// Flip a bit in the first value, and copy the first value over the second one.
+	item, err := c.MemcacheClient.Get(cacheKey(keys[0]))
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedTampered: failed getting raw item from memcached: %v", err)
+	}
+
+	err = c.MemcacheClient.Set(&memcache.Item{Key: cacheKey(keys[1]), Value: item.Value})
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedTampered: failed putting moved item into memcached: %v", err)
+	}
+
+	item.Value[len(item.Value)-1] ^= 1
+	err = c.MemcacheClient.Set(item)
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedTampered: failed putting tampered item into memcached: %v", err)
+	}
+
+	err = c.Store.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscache.TestGetEncryptedTampered: failed deleting data from datastore: %v", err)
+	}
+
+	for _, key := range keys {
+		var dst TestDbData
+		err = c.Get(ctx, key, &dst)
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatalf("godscache.TestGetEncryptedTampered: expected a cache miss and datastore.ErrNoSuchEntity, got: %v", err)
+		}
+
+		_, err = c.MemcacheClient.Get(cacheKey(key))
+		if err != memcache.ErrCacheMiss {
+			t.Fatalf("godscache.TestGetEncryptedTampered: data which failed authentication wasn't evicted from the cache")
+		}
+	}
+}
+
+// TestDbDataRenamed has the same JSON encoding as TestDbData, but a different shape.
+type TestDbDataRenamed struct {
+	TestString string
+	TestExtra  int
+}
+
+func TestFingerprint(t *testing.T) {
+	if fingerprint(reflect.TypeOf(TestDbData{})) != fingerprint(reflect.TypeOf(&TestDbData{})) {
+		t.Fatalf("godscache.TestFingerprint: a type and a pointer to it have different fingerprints")
+	}
+
+	if fingerprint(reflect.TypeOf(TestDbData{})) == fingerprint(reflect.TypeOf(TestDbDataRenamed{})) {
+		t.Fatalf("godscache.TestFingerprint: types with different fields have the same fingerprint")
+	}
+
+	type tagged struct {
+		TestString string `json:"s"`
+	}
+
+	if fingerprint(reflect.TypeOf(TestDbData{})) == fingerprint(reflect.TypeOf(tagged{})) {
+		t.Fatalf("godscache.TestFingerprint: types with different tags have the same fingerprint")
+	}
+
+	type recursive struct {
+		Next *recursive
+	}
+
+	fingerprint(reflect.TypeOf(recursive{}))
+}
+
+func TestGetFingerprintMismatch(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetFingerprintMismatch: no memcached servers were specified")
+	}
+
+	str := "TestGetFingerprintMismatch"
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testEnvelope", nil), &TestDbData{TestString: str})
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	// Change the entity in the datastore only, so it's clear where the data comes from.
+	_, err = c.Store.Put(ctx, key, &TestDbDataRenamed{TestString: str, TestExtra: 42})
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: failed putting data into datastore: %v", err)
+	}
+
+	// The cached data is for a different type, so it's refreshed from the datastore.
+	var dst TestDbDataRenamed
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: failed getting data: %v", err)
+	}
+
+	if dst.TestExtra != 42 {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: data cached for a different type was used")
+	}
+
+	// Now the cache holds data for the new type.
+	err = c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: failed deleting data from datastore: %v", err)
+	}
+
+	dsts := make([]*TestDbDataRenamed, 1)
+	err = c.GetMulti(ctx, []*datastore.Key{key}, dsts)
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: failed getting refreshed data from cache: %v", err)
+	}
+
+	if dsts[0].TestExtra != 42 {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: got the wrong data back from the cache")
+	}
+
+	var old TestDbData
+	err = c.Get(ctx, key, &old)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestGetFingerprintMismatch: expected a cache miss and datastore.ErrNoSuchEntity, got: %v", err)
+	}
+}
+
+func TestGetFingerprintMismatchInvalidateOnWrite(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetFingerprintMismatchInvalidateOnWrite: no memcached servers were specified")
+	}
+
+	str := "TestGetFingerprintMismatchInvalidateOnWrite"
+
+	// Cache the entity as a different type.
+	key, err := c.Put(ctx, datastore.IncompleteKey("testEnvelope", nil), &TestDbData{TestString: str})
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatchInvalidateOnWrite: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	_, err = c.Store.Put(ctx, key, &TestDbDataRenamed{TestString: str, TestExtra: 42})
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatchInvalidateOnWrite: failed putting data into datastore: %v", err)
+	}
+
+	// Fills only add to the cache with InvalidateOnWrite, but they still replace data which was
+	// cached for a different type.
+	c.WriteStrategy = InvalidateOnWrite
+
+	var dst TestDbDataRenamed
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatchInvalidateOnWrite: failed getting data: %v", err)
+	}
+
+	err = c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatchInvalidateOnWrite: failed deleting data from datastore: %v", err)
+	}
+
+	dst = TestDbDataRenamed{}
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetFingerprintMismatchInvalidateOnWrite: data cached for a different type wasn't replaced: %v", err)
+	}
+
+	if dst.TestExtra != 42 {
+		t.Fatalf("godscache.TestGetFingerprintMismatchInvalidateOnWrite: got the wrong data back from the cache")
+	}
+}
+
+func TestGetCorruptEntry(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetCorruptEntry: no memcached servers were specified")
+	}
+
+	str := "TestGetCorruptEntry"
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testCorrupt", nil), &TestDbData{TestString: str})
+	if err != nil {
+		t.Fatalf("godscache.TestGetCorruptEntry: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	// Cache a value with a valid envelope around invalid JSON.
+	corrupt := append([]byte{valueMagic, flagEnvelope}, wrapEnvelope(reflect.TypeOf(TestDbData{}), []byte(`{"TestString":`), time.Now())...)
+	err = c.MemcacheClient.Set(&memcache.Item{Key: cacheKey(key), Value: corrupt})
+	if err != nil {
+		t.Fatalf("godscache.TestGetCorruptEntry: failed putting corrupt item into memcached: %v", err)
+	}
+
+	dst := TestDbData{TestString: "untouched"}
+	if getCached(t, c, key, &dst) {
+		t.Fatalf("godscache.TestGetCorruptEntry: a corrupt entry was a cache hit")
+	}
+
+	if dst.TestString != "untouched" {
+		t.Fatalf("godscache.TestGetCorruptEntry: a corrupt entry changed dst")
+	}
+
+	if c.Stats().CorruptEntries != 1 {
+		t.Fatalf("godscache.TestGetCorruptEntry: expected 1 corrupt entry, got %v", c.Stats().CorruptEntries)
+	}
+
+	_, err = c.MemcacheClient.Get(cacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestGetCorruptEntry: the corrupt entry wasn't deleted from the cache")
+	}
+
+	// Get reads the entity from the datastore instead, and caches it again.
+	err = c.MemcacheClient.Set(&memcache.Item{Key: cacheKey(key), Value: corrupt})
+	if err != nil {
+		t.Fatalf("godscache.TestGetCorruptEntry: failed putting corrupt item into memcached: %v", err)
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetCorruptEntry: failed getting data: %v", err)
+	}
+
+	if dst.TestString != str {
+		t.Fatalf("godscache.TestGetCorruptEntry: got the wrong data back")
+	}
+
+	var cached TestDbData
+	if !getCached(t, c, key, &cached) || cached.TestString != str {
+		t.Fatalf("godscache.TestGetCorruptEntry: the entity wasn't cached again")
+	}
+}
+
+func TestGetMultiCorruptEntry(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetMultiCorruptEntry: no memcached servers were specified")
+	}
+
+	strs := []string{"TestGetMultiCorruptEntry 1", "TestGetMultiCorruptEntry 2"}
+
+	keys := make([]*datastore.Key, 0, len(strs))
+	for _, str := range strs {
+		key, err := c.Put(ctx, datastore.IncompleteKey("testCorrupt", nil), &TestDbData{TestString: str})
+		if err != nil {
+			t.Fatalf("godscache.TestGetMultiCorruptEntry: failed putting data into datastore and cache: %v", err)
+		}
+		defer c.Delete(ctx, key)
+
+		keys = append(keys, key)
+	}
+
+	// Cache a value with flags no version of godscache writes.
+	err = c.MemcacheClient.Set(&memcache.Item{Key: cacheKey(keys[1]), Value: []byte{valueMagic, 0xff, 1, 2, 3}})
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiCorruptEntry: failed putting corrupt item into memcached: %v", err)
+	}
+
+	before := c.Stats()
+
+	dst := make([]TestDbData, len(keys))
+	err = c.GetMulti(ctx, keys, dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiCorruptEntry: a corrupt entry failed GetMulti: %v", err)
+	}
+
+	for idx, str := range strs {
+		if dst[idx].TestString != str {
+			t.Fatalf("godscache.TestGetMultiCorruptEntry: got the wrong data back for item %v", idx)
+		}
+	}
+
+	after := c.Stats()
+	if after.Hits-before.Hits != 1 || after.Misses-before.Misses != 1 || after.CorruptEntries-before.CorruptEntries != 1 {
+		t.Fatalf("godscache.TestGetMultiCorruptEntry: expected 1 hit, 1 miss and 1 corrupt entry, got: %+v", after)
+	}
+
+	var cached TestDbData
+	if !getCached(t, c, keys[1], &cached) || cached.TestString != strs[1] {
+		t.Fatalf("godscache.TestGetMultiCorruptEntry: the entity wasn't cached again")
+	}
+}
+
+func TestPutInvalidateOnWrite(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestPutInvalidateOnWrite: no memcached servers were specified")
+	}
+
+	c.WriteStrategy = InvalidateOnWrite
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testWriteStrategy", nil), &TestDbData{TestString: "TestPutInvalidateOnWrite 1"})
+	if err != nil {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: failed putting data into datastore: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	_, err = c.MemcacheClient.Get(cacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: Put added data to the cache")
+	}
+
+	// The next read caches the entity.
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: failed getting data: %v", err)
+	}
+
+	var cached TestDbData
+	if !getCached(t, c, key, &cached) {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: Get didn't add data to the cache")
+	}
+
+	// A slower read doesn't overwrite what's cached.
+	err = c.fillCache(ctx, key, &TestDbData{TestString: "TestPutInvalidateOnWrite stale"})
+	if err != nil {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: failed filling cache: %v", err)
+	}
+
+	if !getCached(t, c, key, &cached) || cached.TestString != "TestPutInvalidateOnWrite 1" {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: filling the cache overwrote what was cached")
+	}
+
+	// Writing the entity again invalidates it.
+	_, err = c.PutMulti(ctx, []*datastore.Key{key}, []*TestDbData{{TestString: "TestPutInvalidateOnWrite 2"}})
+	if err != nil {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: failed putting data into datastore: %v", err)
+	}
+
+	_, err = c.MemcacheClient.Get(cacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: PutMulti didn't invalidate the cached data")
+	}
+
+	dsts := make([]*TestDbData, 1)
+	err = c.GetMulti(ctx, []*datastore.Key{key}, dsts)
+	if err != nil {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: failed getting data: %v", err)
+	}
+
+	if dsts[0].TestString != "TestPutInvalidateOnWrite 2" {
+		t.Fatalf("godscache.TestPutInvalidateOnWrite: got the wrong data back after invalidating")
+	}
+}
+
+func TestKindPolicyWriteStrategy(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestKindPolicyWriteStrategy: no memcached servers were specified")
+	}
+
+	c.SetKindPolicy("testInvalidated", KindPolicy{WriteStrategy: InvalidateOnWrite})
+
+	if c.KindPolicy("testInvalidated").WriteStrategy != InvalidateOnWrite {
+		t.Fatalf("godscache.TestKindPolicyWriteStrategy: KindPolicy didn't return the policy that was set")
+	}
+
+	invalidated, err := c.Put(ctx, datastore.IncompleteKey("testInvalidated", nil), &TestDbData{TestString: "TestKindPolicyWriteStrategy"})
+	if err != nil {
+		t.Fatalf("godscache.TestKindPolicyWriteStrategy: failed putting data into datastore: %v", err)
+	}
+	defer c.Delete(ctx, invalidated)
+
+	written, err := c.Put(ctx, datastore.IncompleteKey("testWrittenThrough", nil), &TestDbData{TestString: "TestKindPolicyWriteStrategy"})
+	if err != nil {
+		t.Fatalf("godscache.TestKindPolicyWriteStrategy: failed putting data into datastore: %v", err)
+	}
+	defer c.Delete(ctx, written)
+
+	_, err = c.MemcacheClient.Get(cacheKey(invalidated))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestKindPolicyWriteStrategy: Put added data of an invalidate-on-write kind to the cache")
+	}
+
+	_, err = c.MemcacheClient.Get(cacheKey(written))
+	if err != nil {
+		t.Fatalf("godscache.TestKindPolicyWriteStrategy: Put didn't add data of a write-through kind to the cache: %v", err)
+	}
+}
+
+func TestPutMultiIncompleteKeys(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestPutMultiIncompleteKeys: no memcached servers were specified")
+	}
+
+	parent := datastore.NameKey("testPutMultiParent", "TestPutMultiIncompleteKeys", nil)
+	incomplete := []*datastore.Key{
+		datastore.IncompleteKey("testPutMulti", nil),
+		datastore.IncompleteKey("testPutMulti", parent),
+		datastore.IncompleteKey("testPutMulti", nil),
+	}
+	src := []TestDbData{
+		{TestString: "TestPutMultiIncompleteKeys 1"},
+		{TestString: "TestPutMultiIncompleteKeys 2"},
+		{TestString: "TestPutMultiIncompleteKeys 3"},
+	}
+
+	keys, err := c.PutMulti(ctx, incomplete, src)
+	if err != nil {
+		t.Fatalf("godscache.TestPutMultiIncompleteKeys: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.DeleteMulti(ctx, keys)
+
+	seen := make(map[string]bool, len(keys))
+	for idx, key := range keys {
+		if key.Incomplete() || !key.Parent.Equal(incomplete[idx].Parent) || seen[key.String()] {
+			t.Fatalf("godscache.TestPutMultiIncompleteKeys: PutMulti returned an invalid key: %v", key)
+		}
+		seen[key.String()] = true
+	}
+
+	for _, key := range incomplete {
+		_, err = c.MemcacheClient.Get(cacheKey(key))
+		if err != memcache.ErrCacheMiss {
+			t.Fatalf("godscache.TestPutMultiIncompleteKeys: data was cached under the incomplete key %v", key)
+		}
+	}
+
+	// Make sure the entities are read from the cache.
+	err = c.Store.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscache.TestPutMultiIncompleteKeys: failed deleting data from datastore: %v", err)
+	}
+
+	dst := make([]*TestDbData, len(keys))
+	err = c.GetMulti(ctx, keys, dst)
+	if err != nil {
+		t.Fatalf("godscache.TestPutMultiIncompleteKeys: failed getting data from cache: %v", err)
+	}
+
+	for idx := range src {
+		if dst[idx].TestString != src[idx].TestString {
+			t.Fatalf("godscache.TestPutMultiIncompleteKeys: got the wrong data back from the cache for item %v", idx)
+		}
+	}
+}
+
+// TestDbDataPLS is a datastore.KeyLoader, which records the key it was loaded from.
+type TestDbDataPLS struct {
+	TestString string
+	Key        *datastore.Key
+}
+
+func (d *TestDbDataPLS) Load(props []datastore.Property) error {
+	for _, prop := range props {
+		if prop.Name == "TestString" {
+			d.TestString, _ = prop.Value.(string)
+		}
+	}
+	return nil
+}
+
+func (d *TestDbDataPLS) Save() ([]datastore.Property, error) {
+	return []datastore.Property{{Name: "TestString", Value: d.TestString}}, nil
+}
+
+func (d *TestDbDataPLS) LoadKey(k *datastore.Key) error {
+	d.Key = k
+	return nil
+}
+
+// testPropertyList returns a property list with every type of property value.
+func testPropertyList(str string) datastore.PropertyList {
+	key := datastore.NameKey("testPropertyListRef", "ref", datastore.IDKey("testPropertyListParent", 7, nil))
+	key.Namespace = "testNamespace"
+
+	return datastore.PropertyList{
+		{Name: "String", Value: str},
+		{Name: "Int", Value: int64(-42)},
+		{Name: "Bool", Value: true},
+		{Name: "Float", Value: 0.1},
+		{Name: "Nil", Value: nil},
+		{Name: "Key", Value: key},
+		{Name: "Time", Value: time.Date(2018, 2, 3, 4, 5, 6, 7000, time.UTC)},
+		{Name: "Geo", Value: datastore.GeoPoint{Lat: 43.65, Lng: -79.38}},
+		{Name: "Bytes", Value: []byte{0, 1, 2, 255}, NoIndex: true},
+		{Name: "Array", Value: []interface{}{int64(1), "two", 3.0}},
+		{Name: "Entity", Value: &datastore.Entity{
+			Key: key,
+			Properties: []datastore.Property{
+				{Name: "Nested", Value: "nested"},
+				{Name: "Deeper", Value: &datastore.Entity{
+					Properties: []datastore.Property{{Name: "Deepest", Value: int64(3)}},
+				}},
+			},
+		}},
+	}
+}
+
+func TestPropertyListRoundTrip(t *testing.T) {
+	src := testPropertyList("TestPropertyListRoundTrip")
+
+	data, err := marshalEntity(&src)
+	if err != nil {
+		t.Fatalf("godscache.TestPropertyListRoundTrip: failed marshaling property list: %v", err)
+	}
+
+	var dst datastore.PropertyList
+	err = unmarshalEntity(nil, data, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestPropertyListRoundTrip: failed unmarshaling property list: %v", err)
+	}
+
+	if !reflect.DeepEqual(dst, src) {
+		t.Fatalf("godscache.TestPropertyListRoundTrip: property list changed in the cache:\n got: %#v\nwant: %#v", dst, src)
+	}
+}
+
+func TestGetPropertyList(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetPropertyList: no memcached servers were specified")
+	}
+
+	src := testPropertyList("TestGetPropertyList 1")
+	src2 := testPropertyList("TestGetPropertyList 2")
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testPropertyList", nil), &src)
+	if err != nil {
+		t.Fatalf("godscache.TestGetPropertyList: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, key)
+
+	keys, err := c.PutMulti(ctx, []*datastore.Key{datastore.IncompleteKey("testPropertyList", nil)}, []datastore.PropertyList{src2})
+	if err != nil {
+		t.Fatalf("godscache.TestGetPropertyList: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.DeleteMulti(ctx, keys)
+
+	keys = append(keys, key)
+
+	// Make sure the entities are read from the cache.
+	err = c.Store.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscache.TestGetPropertyList: failed deleting data from datastore: %v", err)
+	}
+
+	var dst datastore.PropertyList
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestGetPropertyList: failed getting property list from cache: %v", err)
+	}
+
+	if !reflect.DeepEqual(dst, src) {
+		t.Fatalf("godscache.TestGetPropertyList: got the wrong property list back from the cache")
+	}
+
+	dsts := make([]datastore.PropertyList, len(keys))
+	err = c.GetMulti(ctx, keys, dsts)
+	if err != nil {
+		t.Fatalf("godscache.TestGetPropertyList: failed getting property lists from cache: %v", err)
+	}
+
+	if !reflect.DeepEqual(dsts[0], src2) || !reflect.DeepEqual(dsts[1], src) {
+		t.Fatalf("godscache.TestGetPropertyList: got the wrong property lists back from the cache")
+	}
+}
+
+func TestGetMultiPropertyLoadSaver(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.TestGetMultiPropertyLoadSaver: no memcached servers were specified")
+	}
+
+	plsStr, plStr := "TestGetMultiPropertyLoadSaver PLS", "TestGetMultiPropertyLoadSaver PropertyList"
+
+	keys, err := c.PutMulti(ctx,
+		[]*datastore.Key{datastore.IncompleteKey("testPLS", nil), datastore.IncompleteKey("testPLS", nil)},
+		[]interface{}{&TestDbDataPLS{TestString: plsStr}, &datastore.PropertyList{{Name: "TestString", Value: plStr}}},
+	)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.DeleteMulti(ctx, keys)
+
+	// Read the first entity from the datastore, and the second from the cache.
+	err = c.deleteFromCache(keys[0])
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: failed deleting data from cache: %v", err)
+	}
+
+	pls := &TestDbDataPLS{}
+	pl := &datastore.PropertyList{}
+	err = c.GetMulti(ctx, keys, []interface{}{pls, pl})
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: failed getting data: %v", err)
+	}
+
+	if pls.TestString != plsStr || !pls.Key.Equal(keys[0]) || len(*pl) != 1 || (*pl)[0].Value != plStr {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: got the wrong data back from the datastore and cache")
+	}
+
+	// Now both are cached, and the key is loaded for cached entities too.
+	err = c.Store.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: failed deleting data from datastore: %v", err)
+	}
+
+	dsts := make([]*TestDbDataPLS, 1)
+	err = c.GetMulti(ctx, keys[:1], dsts)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: failed getting data from cache: %v", err)
+	}
+
+	if dsts[0].TestString != plsStr || !dsts[0].Key.Equal(keys[0]) {
+		t.Fatalf("godscache.TestGetMultiPropertyLoadSaver: got the wrong data back from the cache")
+	}
+}
+
+func TestCollection(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	col := NewCollection[TestDbData](c, "testCollection")
+
+	col.SetPolicy(KindPolicy{WriteStrategy: InvalidateOnWrite})
+	if c.KindPolicy("testCollection").WriteStrategy != InvalidateOnWrite {
+		t.Fatalf("godscache.TestCollection: SetPolicy didn't set the policy for the collection's kind")
+	}
+
+	key, err := col.Put(ctx, col.IncompleteKey(nil), &TestDbData{TestString: "TestCollection 1"})
+	if err != nil {
+		t.Fatalf("godscache.TestCollection: failed putting data: %v", err)
+	}
+
+	keys, err := col.PutMulti(ctx, []*datastore.Key{col.IncompleteKey(nil), col.NameKey("named", nil)}, []*TestDbData{
+		{TestString: "TestCollection 2"},
+		{TestString: "TestCollection 3"},
+	})
+	if err != nil {
+		t.Fatalf("godscache.TestCollection: failed putting multiple data: %v", err)
+	}
+
+	keys = append([]*datastore.Key{key}, keys...)
+	defer col.DeleteMulti(ctx, keys)
+
+	dst, err := col.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestCollection: failed getting data: %v", err)
+	}
+
+	if dst.TestString != "TestCollection 1" {
+		t.Fatalf("godscache.TestCollection: got the wrong data back")
+	}
+
+	dsts, err := col.GetMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscache.TestCollection: failed getting multiple data: %v", err)
+	}
+
+	for idx, dst := range dsts {
+		if dst.TestString != fmt.Sprintf("TestCollection %v", idx+1) {
+			t.Fatalf("godscache.TestCollection: got the wrong data back for item %v", idx)
+		}
+	}
+
+	it := col.Run(ctx, col.Query().Filter("TestString =", "TestCollection 3"))
+	dst, found, err := it.Next()
+	if err != nil {
+		t.Fatalf("godscache.TestCollection: failed running query: %v", err)
+	}
+
+	if dst.TestString != "TestCollection 3" || !found.Equal(col.NameKey("named", nil)) {
+		t.Fatalf("godscache.TestCollection: query returned the wrong result")
+	}
+
+	_, _, err = it.Next()
+	if err != iterator.Done {
+		t.Fatalf("godscache.TestCollection: expected iterator.Done, got: %v", err)
+	}
+
+	err = col.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestCollection: failed deleting data: %v", err)
+	}
+
+	_, err = col.Get(ctx, key)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestCollection: expected datastore.ErrNoSuchEntity after deleting, got: %v", err)
+	}
+}
+
+func TestCollectionGetMultiMissing(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	col := NewCollection[TestDbData](c, "testCollection")
+
+	key, err := col.Put(ctx, col.IncompleteKey(nil), &TestDbData{TestString: "TestCollectionGetMultiMissing"})
+	if err != nil {
+		t.Fatalf("godscache.TestCollectionGetMultiMissing: failed putting data: %v", err)
+	}
+	defer col.Delete(ctx, key)
+
+	dsts, err := col.GetMulti(ctx, []*datastore.Key{key, col.NameKey("missing", nil)})
+	errs, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("godscache.TestCollectionGetMultiMissing: expected a datastore.MultiError, got: %v", err)
+	}
+
+	if errs[0] != nil || errs[1] != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestCollectionGetMultiMissing: got the wrong errors back: %v", errs)
+	}
+
+	if len(dsts) != 2 || dsts[0] == nil || dsts[0].TestString != "TestCollectionGetMultiMissing" {
+		t.Fatalf("godscache.TestCollectionGetMultiMissing: didn't get the entity which exists back: %v", dsts)
+	}
+
+	if dsts[1] != nil {
+		t.Fatalf("godscache.TestCollectionGetMultiMissing: expected nil for the missing entity, got: %v", dsts[1])
+	}
+}
+
+func TestCollectionWrongKind(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	col := NewCollection[TestDbData](c, "testCollection")
+	wrong := datastore.IDKey("testOtherKind", 1, nil)
+
+	_, err = col.Get(ctx, wrong)
+	if err == nil {
+		t.Fatalf("godscache.TestCollectionWrongKind: got data with a key of another kind")
+	}
+
+	_, err = col.PutMulti(ctx, []*datastore.Key{col.IncompleteKey(nil), wrong}, []*TestDbData{{}, {}})
+	if err == nil {
+		t.Fatalf("godscache.TestCollectionWrongKind: put data with a key of another kind")
+	}
+
+	err = col.Delete(ctx, nil)
+	if err == nil {
+		t.Fatalf("godscache.TestCollectionWrongKind: deleted data with a nil key")
+	}
+}
+
+// newTestClient makes a client for the tests which need a memcache server, and skips the test if
+// there isn't one.
+func newTestClient(t *testing.T) *Client {
+	c, err := NewClient(context.Background(), os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("Instantiating new Client struct with a valid GCP project ID failed: %v", err)
+	}
+
+	if c.MemcacheClient == nil {
+		t.Skip("godscache.newTestClient: no memcached servers were specified")
+	}
+
+	return c
+}
+
+// putTestEntity puts an entity holding str into the datastore and cache with c, and deletes it
+// again when the test is done.
+func putTestEntity(t *testing.T, c *Client, str string) *datastore.Key {
+	ctx := context.Background()
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testCacheControl", nil), &TestDbData{TestString: str})
+	if err != nil {
+		t.Fatalf("godscache.putTestEntity: failed putting data into datastore and cache: %v", err)
+	}
+	t.Cleanup(func() { c.Delete(ctx, key) })
+
+	return key
+}
+
+func TestWithNoCache(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestWithNoCache 1")
+	noCache := WithNoCache(ctx)
+
+	// Writes invalidate the cache without filling it.
+	_, err := c.Put(noCache, key, &TestDbData{TestString: "TestWithNoCache 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestWithNoCache: failed putting data into datastore: %v", err)
+	}
+
+	_, err = c.MemcacheClient.Get(cacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestWithNoCache: Put left data in the cache")
+	}
+
+	// Reads go to the datastore without filling the cache.
+	var dst TestDbData
+	err = c.Get(noCache, key, &dst)
+	if err != nil || dst.TestString != "TestWithNoCache 2" {
+		t.Fatalf("godscache.TestWithNoCache: failed getting data from datastore: %v", err)
+	}
+
+	dsts := make([]*TestDbData, 1)
+	err = c.GetMulti(noCache, []*datastore.Key{key}, dsts)
+	if err != nil || dsts[0].TestString != "TestWithNoCache 2" {
+		t.Fatalf("godscache.TestWithNoCache: failed getting multiple data from datastore: %v", err)
+	}
+
+	_, err = c.MemcacheClient.Get(cacheKey(key))
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscache.TestWithNoCache: reads filled the cache")
+	}
+}
+
+func TestWithCacheOnly(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestWithCacheOnly")
+	cacheOnly := WithCacheOnly(ctx)
+
+	uncached, err := c.Store.Put(ctx, datastore.IncompleteKey("testCacheControl", nil), &TestDbData{TestString: "TestWithCacheOnly uncached"})
+	if err != nil {
+		t.Fatalf("godscache.TestWithCacheOnly: failed putting data into datastore: %v", err)
+	}
+	defer c.Delete(ctx, uncached)
+
+	var dst TestDbData
+	err = c.Get(cacheOnly, key, &dst)
+	if err != nil || dst.TestString != "TestWithCacheOnly" {
+		t.Fatalf("godscache.TestWithCacheOnly: failed getting data from cache: %v", err)
+	}
+
+	err = c.Get(cacheOnly, uncached, &dst)
+	if err != ErrNotCached {
+		t.Fatalf("godscache.TestWithCacheOnly: expected ErrNotCached for an uncached entity, got: %v", err)
+	}
+
+	dsts := make([]*TestDbData, 2)
+	err = c.GetMulti(cacheOnly, []*datastore.Key{key, uncached}, dsts)
+	merr, ok := err.(datastore.MultiError)
+	if !ok || merr[0] != nil || merr[1] != ErrNotCached {
+		t.Fatalf("godscache.TestWithCacheOnly: expected a MultiError with ErrNotCached for the uncached entity, got: %v", err)
+	}
+
+	if dsts[0] == nil || dsts[0].TestString != "TestWithCacheOnly" {
+		t.Fatalf("godscache.TestWithCacheOnly: GetMulti didn't return the cached entity")
+	}
+
+	_, err = c.Put(cacheOnly, key, &dst)
+	if err == nil {
+		t.Fatalf("godscache.TestWithCacheOnly: Put succeeded with WithCacheOnly")
+	}
+
+	err = c.Delete(cacheOnly, key)
+	if err == nil {
+		t.Fatalf("godscache.TestWithCacheOnly: Delete succeeded with WithCacheOnly")
+	}
+
+	_, err = c.RunStore(cacheOnly, datastore.NewQuery("testCacheControl")).Next(&dst)
+	if err == nil || err == iterator.Done {
+		t.Fatalf("godscache.TestWithCacheOnly: RunStore succeeded with WithCacheOnly")
+	}
+
+	if c.Parent != nil && !panics(func() { c.Run(cacheOnly, datastore.NewQuery("testCacheControl")) }) {
+		t.Fatalf("godscache.TestWithCacheOnly: Run didn't panic with WithCacheOnly")
+	}
+}
+
+func TestWithRefresh(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestWithRefresh 1")
+	c.WriteStrategy = InvalidateOnWrite
+
+	// Change the entity in the datastore only.
+	_, err := c.Store.Put(ctx, key, &TestDbData{TestString: "TestWithRefresh 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestWithRefresh: failed putting data into datastore: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.Get(WithRefresh(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestWithRefresh 2" {
+		t.Fatalf("godscache.TestWithRefresh: failed getting fresh data from datastore: %v", err)
+	}
+
+	var cached TestDbData
+	if !getCached(t, c, key, &cached) || cached.TestString != "TestWithRefresh 2" {
+		t.Fatalf("godscache.TestWithRefresh: Get didn't overwrite the cached data")
+	}
+
+	// Writes are written through, despite the write strategy.
+	_, err = c.Put(WithRefresh(ctx), key, &TestDbData{TestString: "TestWithRefresh 3"})
+	if err != nil {
+		t.Fatalf("godscache.TestWithRefresh: failed putting data into datastore and cache: %v", err)
+	}
+
+	if !getCached(t, c, key, &cached) || cached.TestString != "TestWithRefresh 3" {
+		t.Fatalf("godscache.TestWithRefresh: Put didn't write through to the cache")
+	}
+}
+
+func TestWithMaxStaleness(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestWithMaxStaleness 1")
+
+	// Change the entity in the datastore only.
+	_, err := c.Store.Put(ctx, key, &TestDbData{TestString: "TestWithMaxStaleness 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestWithMaxStaleness: failed putting data into datastore: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.Get(WithMaxStaleness(ctx, time.Hour), key, &dst)
+	if err != nil || dst.TestString != "TestWithMaxStaleness 1" {
+		t.Fatalf("godscache.TestWithMaxStaleness: failed getting data which is fresh enough from cache: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	dsts := make([]*TestDbData, 1)
+	err = c.GetMulti(WithMaxStaleness(ctx, 10*time.Millisecond), []*datastore.Key{key}, dsts)
+	if err != nil || dsts[0].TestString != "TestWithMaxStaleness 2" {
+		t.Fatalf("godscache.TestWithMaxStaleness: failed getting fresh data from datastore: %v", err)
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestString != "TestWithMaxStaleness 2" {
+		t.Fatalf("godscache.TestWithMaxStaleness: stale data wasn't replaced in the cache: %v", err)
+	}
+}
+
+func TestKindPolicyMaxAge(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	stale := putTestEntity(t, c, "TestKindPolicyMaxAge 1")
+	c.SetKindPolicy("testCacheControl", KindPolicy{MaxAge: 50 * time.Millisecond})
+
+	time.Sleep(60 * time.Millisecond)
+
+	fresh, err := c.Put(ctx, datastore.IncompleteKey("testCacheControl", nil), &TestDbData{TestString: "TestKindPolicyMaxAge 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestKindPolicyMaxAge: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, fresh)
+
+	// Change both entities in the datastore only.
+	_, err = c.Store.PutMulti(ctx, []*datastore.Key{stale, fresh}, []*TestDbData{
+		{TestString: "TestKindPolicyMaxAge 3"},
+		{TestString: "TestKindPolicyMaxAge 4"},
+	})
+	if err != nil {
+		t.Fatalf("godscache.TestKindPolicyMaxAge: failed putting data into datastore: %v", err)
+	}
+
+	// Only the entity which was cached too long ago is read from the datastore.
+	dsts := make([]*TestDbData, 2)
+	err = c.GetMulti(ctx, []*datastore.Key{stale, fresh}, dsts)
+	if err != nil {
+		t.Fatalf("godscache.TestKindPolicyMaxAge: failed getting data: %v", err)
+	}
+
+	if dsts[0].TestString != "TestKindPolicyMaxAge 3" {
+		t.Fatalf("godscache.TestKindPolicyMaxAge: stale data was read from cache: %v", dsts[0].TestString)
+	}
+
+	if dsts[1].TestString != "TestKindPolicyMaxAge 2" {
+		t.Fatalf("godscache.TestKindPolicyMaxAge: fresh data wasn't read from cache: %v", dsts[1].TestString)
+	}
+}
+
+func TestClientMaxAge(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestClientMaxAge 1")
+	c.MaxAge = 10 * time.Millisecond
+
+	// Change the entity in the datastore only.
+	_, err := c.Store.Put(ctx, key, &TestDbData{TestString: "TestClientMaxAge 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestClientMaxAge: failed putting data into datastore: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// A maximum staleness in the context overrides the Client's MaxAge.
+	var dst TestDbData
+	err = c.Get(WithMaxStaleness(ctx, time.Hour), key, &dst)
+	if err != nil || dst.TestString != "TestClientMaxAge 1" {
+		t.Fatalf("godscache.TestClientMaxAge: failed getting data which is fresh enough from cache: %v", err)
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestString != "TestClientMaxAge 2" {
+		t.Fatalf("godscache.TestClientMaxAge: failed getting fresh data from datastore: %v", err)
+	}
+}
+
+// waitForRefreshes waits until the client has refreshed n entities in the background.
+func waitForRefreshes(t *testing.T, c *Client, n uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Refreshes < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("godscache.waitForRefreshes: timed out waiting for %v background refreshes", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSoftTTL(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestSoftTTL 1")
+	c.SoftTTL = 10 * time.Millisecond
+
+	// Change the entity in the datastore only.
+	_, err := c.Store.Put(ctx, key, &TestDbData{TestString: "TestSoftTTL 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestSoftTTL: failed putting data into datastore: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The stale entity is still read from the cache, and refreshed in the background.
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestString != "TestSoftTTL 1" {
+		t.Fatalf("godscache.TestSoftTTL: failed getting stale data from cache: %v", err)
+	}
+
+	waitForRefreshes(t, c, 1)
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestSoftTTL 2" {
+		t.Fatalf("godscache.TestSoftTTL: cache wasn't refreshed: %v", err)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestRefreshAhead 1")
+	c.SetKindPolicy("testCacheControl", KindPolicy{MaxAge: time.Hour, RefreshAhead: time.Hour - 10*time.Millisecond})
+
+	// Change the entity in the datastore only.
+	_, err := c.Store.Put(ctx, key, &TestDbData{TestString: "TestRefreshAhead 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestRefreshAhead: failed putting data into datastore: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	dsts := make([]*TestDbData, 1)
+	err = c.GetMulti(ctx, []*datastore.Key{key}, dsts)
+	if err != nil || dsts[0].TestString != "TestRefreshAhead 1" {
+		t.Fatalf("godscache.TestRefreshAhead: failed getting data from cache: %v", err)
+	}
+
+	waitForRefreshes(t, c, 1)
+
+	var dst TestDbData
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestRefreshAhead 2" {
+		t.Fatalf("godscache.TestRefreshAhead: cache wasn't refreshed ahead of its maximum age: %v", err)
+	}
+}
+
+func TestRefreshDeleted(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestRefreshDeleted")
+	c.SetKindPolicy("testCacheControl", KindPolicy{MaxAge: time.Hour, RefreshAhead: time.Hour - 10*time.Millisecond})
+
+	// Delete the entity from the datastore only.
+	err := c.Store.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestRefreshDeleted: failed deleting data from datastore: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	var dst TestDbData
+	err = c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestRefreshDeleted: failed getting data from cache: %v", err)
+	}
+
+	// The refresh finds the entity was deleted, and caches a tombstone in its place.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		item, err := c.MemcacheClient.Get(cacheKey(key))
+		if err == nil && isTombstone(item.Value) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("godscache.TestRefreshDeleted: timed out waiting for a tombstone: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestRefreshDeleted: expected datastore.ErrNoSuchEntity from the cache, got: %v", err)
+	}
+}
+
+func TestCloseStopsRefreshes(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestCloseStopsRefreshes")
+	c.SoftTTL = time.Nanosecond
+
+	var dst TestDbData
+	err := c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestCloseStopsRefreshes: failed getting data: %v", err)
+	}
+
+	waitForRefreshes(t, c, 1)
+
+	err = c.Close()
+	if err != nil {
+		t.Fatalf("godscache.TestCloseStopsRefreshes: failed closing client: %v", err)
+	}
+
+	// Nothing is queued after the client is closed.
+	c.scheduleRefresh(ctx, key, reflect.TypeOf(dst))
+
+	c.refresher.mu.Lock()
+	pending := len(c.refresher.pending)
+	c.refresher.mu.Unlock()
+
+	if pending != 0 {
+		t.Fatalf("godscache.TestCloseStopsRefreshes: a refresh was queued after closing the client")
+	}
+}
+
+func TestDeleteTombstone(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestDeleteTombstone 1")
+
+	err := c.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestDeleteTombstone: failed deleting data from datastore and cache: %v", err)
+	}
+
+	// A read which raced with the delete can't cache the deleted entity again.
+	err = c.fillCache(ctx, key, &TestDbData{TestString: "TestDeleteTombstone 1"})
+	if err != nil {
+		t.Fatalf("godscache.TestDeleteTombstone: failed filling cache: %v", err)
+	}
+
+	var dst TestDbData
+	_, err = c.getFromCache(ctx, key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestDeleteTombstone: tombstone wasn't found in cache: %v", err)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestDeleteTombstone: deleted entity was read from cache: %v", err)
+	}
+
+	// Putting the entity again replaces its tombstone.
+	_, err = c.Put(ctx, key, &TestDbData{TestString: "TestDeleteTombstone 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestDeleteTombstone: failed putting data into datastore and cache: %v", err)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestDeleteTombstone 2" {
+		t.Fatalf("godscache.TestDeleteTombstone: tombstone wasn't replaced by a put: %v", err)
+	}
+}
+
+func TestDeleteMultiTombstone(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	deleted := putTestEntity(t, c, "TestDeleteMultiTombstone 1")
+
+	kept, err := c.Put(ctx, datastore.IncompleteKey("testCacheControl", nil), &TestDbData{TestString: "TestDeleteMultiTombstone 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestDeleteMultiTombstone: failed putting data into datastore and cache: %v", err)
+	}
+	defer c.Delete(ctx, kept)
+
+	err = c.DeleteMulti(ctx, []*datastore.Key{deleted})
+	if err != nil {
+		t.Fatalf("godscache.TestDeleteMultiTombstone: failed deleting data from datastore and cache: %v", err)
+	}
+
+	dsts := make([]*TestDbData, 2)
+	err = c.GetMulti(WithCacheOnly(ctx), []*datastore.Key{deleted, kept}, dsts)
+	errs, ok := err.(datastore.MultiError)
+	if !ok || errs[0] != datastore.ErrNoSuchEntity || errs[1] != nil {
+		t.Fatalf("godscache.TestDeleteMultiTombstone: expected the deleted entity to be reported missing: %v", err)
+	}
+
+	if dsts[1] == nil || dsts[1].TestString != "TestDeleteMultiTombstone 2" {
+		t.Fatalf("godscache.TestDeleteMultiTombstone: failed getting the entity which wasn't deleted: %+v", dsts[1])
+	}
+}
+
+func TestLoader(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	dsClient, err := datastore.NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestLoader: instantiating new datastore client failed: %v", err)
+	}
+
+	store := &recordingStore{Store: NewDatastoreStore(dsClient)}
+
+	c, err := NewClientWithStore(ctx, os.Getenv("GODSCACHE_PROJECT_ID"), store)
+	if err != nil {
+		t.Fatalf("godscache.TestLoader: instantiating new Client struct with a custom store failed: %v", err)
+	}
+	defer c.Close()
+
+	strs := []string{"TestLoader 1", "TestLoader 2", "TestLoader 3"}
+	keys := make([]*datastore.Key, 0, len(strs)+1)
+	for _, str := range strs {
+		key, err := c.Put(ctx, datastore.IncompleteKey("testLoader", nil), &TestDbData{TestString: str})
+		if err != nil {
+			t.Fatalf("godscache.TestLoader: failed putting data into datastore and cache: %v", err)
+		}
+		defer c.Delete(ctx, key)
+
+		keys = append(keys, key)
+	}
+
+	// One entity isn't cached, one is read twice, and one doesn't exist.
+	err = c.deleteFromCache(keys[0])
+	if err != nil {
+		t.Fatalf("godscache.TestLoader: failed deleting data from cache: %v", err)
+	}
+	keys = append(keys, keys[0], datastore.NameKey("testLoader", "missing", nil))
+
+	l := NewLoader(c)
+	l.Wait = time.Hour
+	l.MaxBatchSize = len(keys)
+
+	dsts := make([]TestDbData, len(keys))
+	errs := make([]error, len(keys))
+
+	var wg sync.WaitGroup
+	for idx := range keys {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			errs[idx] = l.Get(ctx, keys[idx], &dsts[idx])
+		}(idx)
+	}
+	wg.Wait()
+
+	for idx, str := range append(strs, strs[0]) {
+		if errs[idx] != nil || dsts[idx].TestString != str {
+			t.Fatalf("godscache.TestLoader: failed getting %v: %v", keys[idx], errs[idx])
+		}
+	}
+
+	if errs[len(keys)-1] != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestLoader: expected the missing entity not to be found: %v", errs[len(keys)-1])
+	}
+
+	if c.MemcacheClient != nil && (store.getMultis != 1 || store.gets != 0) {
+		t.Fatalf("godscache.TestLoader: expected 1 batched datastore read, got %v batches and %v single reads", store.getMultis, store.gets)
+	}
+}
+
+func TestLoaderWait(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestLoaderWait")
+
+	// A batch which isn't full is loaded after waiting.
+	l := NewLoader(c)
+
+	var dst TestDbData
+	err := l.Get(WithCacheOnly(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestLoaderWait" {
+		t.Fatalf("godscache.TestLoaderWait: failed getting data from cache: %v", err)
+	}
+
+	err = l.Get(ctx, key, dst)
+	if err == nil {
+		t.Fatalf("godscache.TestLoaderWait: getting data into a non-pointer succeeded")
+	}
+
+	// A call which stops waiting is left untouched when its batch is loaded.
+	l.Wait = 10 * time.Millisecond
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	var abandoned TestDbData
+	err = l.Get(cancelled, key, &abandoned)
+	if err != context.Canceled {
+		t.Fatalf("godscache.TestLoaderWait: expected context.Canceled, got: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if abandoned.TestString != "" {
+		t.Fatalf("godscache.TestLoaderWait: a cancelled call's dst was written to")
+	}
+}
+
+func TestRequestCache(t *testing.T) {
+	resetEmulator(t)
+
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestRequestCache 1")
+	ctx := WithRequestCache(context.Background())
+
+	var dst TestDbData
+	err := c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed getting data: %v", err)
+	}
+
+	// Once it's been read, the entity is read from the request cache, even if it's no longer
+	// in memcache, and each read gets its own copy.
+	err = c.deleteFromCache(key)
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed deleting data from cache: %v", err)
+	}
+	dst.TestString = "changed"
+
+	dsts := make([]*TestDbData, 1)
+	err = c.GetMulti(WithCacheOnly(ctx), []*datastore.Key{key}, dsts)
+	if err != nil || dsts[0].TestString != "TestRequestCache 1" {
+		t.Fatalf("godscache.TestRequestCache: failed getting data from request cache: %v", err)
+	}
+
+	// Writes update the request cache.
+	_, err = c.Put(ctx, key, &TestDbData{TestString: "TestRequestCache 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed putting data into datastore and cache: %v", err)
+	}
+
+	err = c.deleteFromCache(key)
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed deleting data from cache: %v", err)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestRequestCache 2" {
+		t.Fatalf("godscache.TestRequestCache: request cache wasn't updated by a put: %v", err)
+	}
+
+	err = c.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed deleting data from datastore and cache: %v", err)
+	}
+
+	err = c.deleteFromCache(key)
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed deleting data from cache: %v", err)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestRequestCache: request cache wasn't updated by a delete: %v", err)
+	}
+
+	// Contexts without the request cache don't see it.
+	err = c.Get(WithCacheOnly(context.Background()), key, &dst)
+	if err != ErrNotCached {
+		t.Fatalf("godscache.TestRequestCache: request cache was used without its context: %v", err)
+	}
+
+	// Reads which raced with the delete don't replace its record in the request cache.
+	err = c.fillCache(ctx, key, &TestDbData{TestString: "TestRequestCache 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestRequestCache: failed filling cache: %v", err)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestRequestCache: a read replaced the request cache's record of a delete: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	resetEmulator(t)
+
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestMiddleware")
+
+	var reqCtx context.Context
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCtx = r.Context()
+
+		var dst TestDbData
+		err := c.Get(reqCtx, key, &dst)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, dst.TestString)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Body.String() != "TestMiddleware" {
+		t.Fatalf("godscache.TestMiddleware: unexpected response: %v", rec.Body.String())
+	}
+
+	// The request cache is discarded at the end of the request.
+	rc := requestCacheFrom(reqCtx)
+	if rc == nil {
+		t.Fatalf("godscache.TestMiddleware: no request cache was attached to the request")
+	}
+
+	var dst TestDbData
+	err := c.Get(reqCtx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestMiddleware: failed getting data after the request: %v", err)
+	}
+
+	if _, ok := rc.get(cacheKey(key)); ok {
+		t.Fatalf("godscache.TestMiddleware: request cache was used after the request")
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestLocalCache 1")
+	c.LocalCacheSize = 2
+
+	var dst TestDbData
+	err := c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestLocalCache: failed getting data: %v", err)
+	}
+
+	// Once it's been read, the entity is read from the local cache, even if it's no longer in
+	// memcache.
+	err = c.deleteFromCache(key)
+	if err != nil {
+		t.Fatalf("godscache.TestLocalCache: failed deleting data from cache: %v", err)
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != nil || dst.TestString != "TestLocalCache 1" {
+		t.Fatalf("godscache.TestLocalCache: failed getting data from local cache: %v", err)
+	}
+
+	// The least recently used entities are forgotten when there's no room for more.
+	for _, str := range []string{"TestLocalCache 2", "TestLocalCache 3"} {
+		key, err := c.Put(ctx, datastore.IncompleteKey("testCacheControl", nil), &TestDbData{TestString: str})
+		if err != nil {
+			t.Fatalf("godscache.TestLocalCache: failed putting data into datastore and cache: %v", err)
+		}
+		defer c.Delete(ctx, key)
+	}
+
+	if c.local.len() != 2 {
+		t.Fatalf("godscache.TestLocalCache: expected 2 entities in the local cache, got %v", c.local.len())
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != ErrNotCached {
+		t.Fatalf("godscache.TestLocalCache: least recently used entity wasn't forgotten: %v", err)
+	}
+}
+
+func TestLocalCacheRacingDelete(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestLocalCacheRacingDelete")
+	c.LocalCacheSize = 2
+
+	var dst TestDbData
+	err := c.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestLocalCacheRacingDelete: failed getting data: %v", err)
+	}
+
+	// A read which started before a delete finds the delete's tombstone when it fills the
+	// cache, so what it read isn't kept in the local cache either.
+	err = c.tombstoneCache([]*datastore.Key{key})
+	if err != nil {
+		t.Fatalf("godscache.TestLocalCacheRacingDelete: failed caching tombstone: %v", err)
+	}
+	c.deleteFromMemory(ctx, []*datastore.Key{key}, true)
+
+	err = c.fillCache(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestLocalCacheRacingDelete: failed filling cache: %v", err)
+	}
+
+	if _, ok := c.local.get(cacheKey(key)); ok {
+		t.Fatalf("godscache.TestLocalCacheRacingDelete: data read before a delete was kept in the local cache")
+	}
+
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestLocalCacheRacingDelete: expected datastore.ErrNoSuchEntity, got: %v", err)
+	}
+}
+
+func TestLocalInvalidator(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c1 := newTestClient(t)
+	key := putTestEntity(t, c1, "TestLocalInvalidator 1")
+
+	c2, err := NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestLocalInvalidator: instantiating new Client struct failed: %v", err)
+	}
+	defer c2.Close()
+
+	inv := NewLocalInvalidator()
+	for _, c := range []*Client{c1, c2} {
+		c.LocalCacheSize = 10
+
+		err = c.SetInvalidator(inv)
+		if err != nil {
+			t.Fatalf("godscache.TestLocalInvalidator: failed setting invalidator: %v", err)
+		}
+	}
+
+	var dst TestDbData
+	err = c2.Get(ctx, key, &dst)
+	if err != nil {
+		t.Fatalf("godscache.TestLocalInvalidator: failed getting data: %v", err)
+	}
+
+	// A write through one client makes the other forget its local copy.
+	_, err = c1.Put(ctx, key, &TestDbData{TestString: "TestLocalInvalidator 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestLocalInvalidator: failed putting data into datastore and cache: %v", err)
+	}
+
+	if _, ok := c2.local.get(cacheKey(key)); ok {
+		t.Fatalf("godscache.TestLocalInvalidator: entity wasn't forgotten from the local cache")
+	}
+
+	// The client which wrote it keeps what it wrote.
+	if _, ok := c1.local.get(cacheKey(key)); !ok {
+		t.Fatalf("godscache.TestLocalInvalidator: writing client forgot its own write")
+	}
+
+	err = c2.Get(ctx, key, &dst)
+	if err != nil || dst.TestString != "TestLocalInvalidator 2" {
+		t.Fatalf("godscache.TestLocalInvalidator: failed getting new data: %v", err)
+	}
+}
+
+func TestTCPInvalidator(t *testing.T) {
+	a, err := NewTCPInvalidator("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("godscache.TestTCPInvalidator: failed making invalidator: %v", err)
+	}
+	defer a.Close()
+
+	b, err := NewTCPInvalidator("127.0.0.1:0", a.Addr().String())
+	if err != nil {
+		t.Fatalf("godscache.TestTCPInvalidator: failed making invalidator: %v", err)
+	}
+	defer b.Close()
+
+	a.AddPeer(b.Addr().String())
+
+	received := make(chan Invalidation, 1)
+	unsubscribe, err := b.Subscribe(func(inv Invalidation) {
+		if inv.Source == "a" {
+			received <- inv
+		}
+	})
+	if err != nil {
+		t.Fatalf("godscache.TestTCPInvalidator: failed subscribing: %v", err)
+	}
+	defer unsubscribe()
+
+	key := datastore.NameKey("testTCPInvalidator", "child", datastore.IDKey("testTCPInvalidator", 1, nil))
+	key.Namespace = "ns"
+
+	err = a.Publish(context.Background(), Invalidation{Source: "a", Keys: []*datastore.Key{key}})
+	if err != nil {
+		t.Fatalf("godscache.TestTCPInvalidator: failed publishing invalidation: %v", err)
+	}
+
+	select {
+	case inv := <-received:
+		if len(inv.Keys) != 1 || !inv.Keys[0].Equal(key) {
+			t.Fatalf("godscache.TestTCPInvalidator: received the wrong keys: %v", inv.Keys)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("godscache.TestTCPInvalidator: timed out waiting for invalidation")
+	}
+
+	// Publishing to a peer which isn't there fails, after publishing to the others.
+	a.AddPeer("127.0.0.1:1")
+
+	err = a.Publish(context.Background(), Invalidation{Source: "a", Keys: []*datastore.Key{key}})
+	if err == nil {
+		t.Fatalf("godscache.TestTCPInvalidator: publishing to a missing peer succeeded")
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("godscache.TestTCPInvalidator: timed out waiting for invalidation")
+	}
+}
+
+func TestTCPInvalidatorCloseRacingAddPeer(t *testing.T) {
+	inv, err := NewTCPInvalidator("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("godscache.TestTCPInvalidatorCloseRacingAddPeer: failed making invalidator: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for idx := 0; idx < 100; idx++ {
+			inv.AddPeer(fmt.Sprintf("127.0.0.1:%v", 1+idx))
+		}
+	}()
+
+	inv.Close()
+	wg.Wait()
+}
+
+func TestTagged(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestTagged")
+
+	type profile struct {
+		Name    string
+		Entries int
+	}
+
+	set := func() {
+		err := c.SetTagged(ctx, "profile", profile{Name: "TestTagged", Entries: 3}, KeyTag(key), "custom tag")
+		if err != nil {
+			t.Fatalf("godscache.TestTagged: failed setting tagged value: %v", err)
+		}
+	}
+
+	get := func() bool {
+		var dst profile
+
+		found, err := c.GetTagged(ctx, "profile", &dst)
+		if err != nil {
+			t.Fatalf("godscache.TestTagged: failed getting tagged value: %v", err)
+		}
+		if found && (dst.Name != "TestTagged" || dst.Entries != 3) {
+			t.Fatalf("godscache.TestTagged: got the wrong tagged value: %+v", dst)
+		}
+
+		return found
+	}
+
+	set()
+	if !get() {
+		t.Fatalf("godscache.TestTagged: tagged value wasn't cached")
+	}
+
+	// Values of another type aren't used.
+	var other TestDbData
+	found, err := c.GetTagged(ctx, "profile", &other)
+	if err != nil || found {
+		t.Fatalf("godscache.TestTagged: tagged value was got as another type: %v", err)
+	}
+
+	err = c.InvalidateTags(ctx, "custom tag")
+	if err != nil {
+		t.Fatalf("godscache.TestTagged: failed invalidating tag: %v", err)
+	}
+	if get() {
+		t.Fatalf("godscache.TestTagged: tagged value was got after its tag was invalidated")
+	}
+
+	// Writing and deleting the entity invalidates its tag.
+	set()
+	_, err = c.Put(ctx, key, &TestDbData{TestString: "TestTagged 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestTagged: failed putting data into datastore and cache: %v", err)
+	}
+	if get() {
+		t.Fatalf("godscache.TestTagged: tagged value was got after its entity was put")
+	}
+
+	set()
+	err = c.DeleteMulti(ctx, []*datastore.Key{key})
+	if err != nil {
+		t.Fatalf("godscache.TestTagged: failed deleting data from datastore and cache: %v", err)
+	}
+	if get() {
+		t.Fatalf("godscache.TestTagged: tagged value was got after its entity was deleted")
+	}
+}
+
+func TestKeyTag(t *testing.T) {
+	key := datastore.IDKey("testKeyTag", 1, nil)
+
+	other := datastore.IDKey("testKeyTag", 1, nil)
+	other.Namespace = "other"
+
+	if KeyTag(key) != KeyTag(datastore.IDKey("testKeyTag", 1, nil)) {
+		t.Fatalf("godscache.TestKeyTag: equal keys have different tags")
+	}
+
+	if KeyTag(key) == KeyTag(other) {
+		t.Fatalf("godscache.TestKeyTag: keys in different namespaces have the same tag")
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestMemoize")
+
+	type leaderboard struct {
+		Names []string
+	}
+
+	// Concurrent calls share one computation.
+	var computed sync.WaitGroup
+	compute := func() (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return leaderboard{Names: []string{"a", "b"}}, nil
+	}
+
+	dsts := make([]leaderboard, 10)
+	errs := make([]error, len(dsts))
+	for idx := range dsts {
+		computed.Add(1)
+		go func(idx int) {
+			defer computed.Done()
+			errs[idx] = c.Memoize(ctx, "leaderboard", time.Hour, &dsts[idx], compute, KeyTag(key))
+		}(idx)
+	}
+	computed.Wait()
+
+	for idx, dst := range dsts {
+		if errs[idx] != nil || len(dst.Names) != 2 || dst.Names[1] != "b" {
+			t.Fatalf("godscache.TestMemoize: failed memoizing value: %v: %+v", errs[idx], dst)
+		}
+	}
+
+	if c.Stats().Computations != 1 {
+		t.Fatalf("godscache.TestMemoize: expected 1 computation, got %v", c.Stats().Computations)
+	}
+
+	// Cached values aren't computed again.
+	failing := func() (interface{}, error) {
+		return nil, errors.New("computed again")
+	}
+
+	var dst leaderboard
+	err := c.Memoize(WithCacheOnly(ctx), "leaderboard", time.Hour, &dst, failing, KeyTag(key))
+	if err != nil || len(dst.Names) != 2 {
+		t.Fatalf("godscache.TestMemoize: failed getting memoized value from cache: %v", err)
+	}
+
+	// Writing a linked entity invalidates the value.
+	_, err = c.Put(ctx, key, &TestDbData{TestString: "TestMemoize 2"})
+	if err != nil {
+		t.Fatalf("godscache.TestMemoize: failed putting data into datastore and cache: %v", err)
+	}
+
+	err = c.Memoize(ctx, "leaderboard", time.Hour, &dst, failing, KeyTag(key))
+	if err == nil || err.Error() != "computed again" {
+		t.Fatalf("godscache.TestMemoize: memoized value wasn't invalidated by a put: %v", err)
+	}
+}
+
+func TestMemoizeWriteDuringCompute(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestMemoizeWriteDuringCompute 1")
+
+	// The linked entity is written after the value's data was read, but before it's cached.
+	compute := func() (interface{}, error) {
+		var dst TestDbData
+		err := c.Get(ctx, key, &dst)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = c.Put(ctx, key, &TestDbData{TestString: "TestMemoizeWriteDuringCompute 2"})
+		if err != nil {
+			return nil, err
+		}
+
+		return dst.TestString, nil
+	}
+
+	var dst string
+	err := c.Memoize(ctx, "latest", time.Hour, &dst, compute, KeyTag(key))
+	if err != nil || dst != "TestMemoizeWriteDuringCompute 1" {
+		t.Fatalf("godscache.TestMemoizeWriteDuringCompute: failed memoizing value: %v: %v", err, dst)
+	}
+
+	// The value was cached with the tag's version from before the write, so it's stale, and
+	// it's computed again.
+	failing := func() (interface{}, error) {
+		return nil, errors.New("computed again")
+	}
+
+	err = c.Memoize(ctx, "latest", time.Hour, &dst, failing, KeyTag(key))
+	if err == nil || err.Error() != "computed again" {
+		t.Fatalf("godscache.TestMemoizeWriteDuringCompute: a value computed from stale data was used: %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	if expiration(0) != 0 {
+		t.Fatalf("godscache.TestExpiration: expected no expiration for a ttl of 0")
+	}
+
+	if expiration(1500*time.Millisecond) != 2 {
+		t.Fatalf("godscache.TestExpiration: expected the ttl to be rounded up to whole seconds, got %v", expiration(1500*time.Millisecond))
+	}
+
+	if exp := expiration(60 * 24 * time.Hour); int64(exp) < time.Now().Unix() {
+		t.Fatalf("godscache.TestExpiration: expected a ttl of more than 30 days to be a Unix time, got %v", exp)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	key := datastore.NameKey("testCacheKey", "name", nil)
+	namespaced := datastore.NameKey("testCacheKey", "name", nil)
+	namespaced.Namespace = "ns"
+
+	if cacheKey(key) == cacheKey(namespaced) {
+		t.Fatalf("godscache.TestCacheKey: keys in different namespaces have the same cache key")
+	}
+
+	for _, name := range []string{"with spaces", "ünïcødé", strings.Repeat("x", 1000)} {
+		keyStr := cacheKey(datastore.NameKey("testCacheKey", name, nil))
+		if len(keyStr) > maxCacheKeyLen || strings.ContainsAny(keyStr, " \t\r\n") {
+			t.Fatalf("godscache.TestCacheKey: invalid memcache key for name %q: %q", name, keyStr)
+		}
+	}
+}
+
+func TestUniqueMarkerKey(t *testing.T) {
+	pairs := [][2]*datastore.Key{
+		{uniqueMarkerKey("", "a", "b/c", "d"), uniqueMarkerKey("", "a", "b", "c/d")},
+		{uniqueMarkerKey("", "a/b", "c", "d"), uniqueMarkerKey("", "a", "b/c", "d")},
+		{uniqueMarkerKey("", "a1", "b", "c"), uniqueMarkerKey("", "a", "1b", "c")},
+		{uniqueMarkerKey("", "a", "b", "5"), uniqueMarkerKey("", "a", "b", 5)},
+		{uniqueMarkerKey("", "a", "b", "c"), uniqueMarkerKey("", "a", "b", []byte("c"))},
+	}
+
+	for _, pair := range pairs {
+		if pair[0].Equal(pair[1]) {
+			t.Fatalf("godscache.TestUniqueMarkerKey: different kinds, fields and values have the same marker: %v", pair[0])
+		}
+	}
+
+	// Integers have the same marker whatever their type, since the datastore stores them all
+	// as int64.
+	if !uniqueMarkerKey("", "a", "b", 5).Equal(uniqueMarkerKey("", "a", "b", int64(5))) {
+		t.Fatalf("godscache.TestUniqueMarkerKey: the same integer has different markers for different types")
+	}
+}
+
+func TestUniqueIndexValues(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	c.SetUniqueIndex("testUnique", "TestString")
+
+	for _, value := range []string{"with spaces", "ünïcødé ✓", strings.Repeat("long", 100)} {
+		key, err := c.Put(ctx, datastore.IncompleteKey("testUnique", nil), &TestDbData{TestString: value})
+		if err != nil {
+			t.Fatalf("godscache.TestUniqueIndexValues: failed putting %q into datastore and cache: %v", value, err)
+		}
+
+		var dst TestDbData
+		err = c.GetBy(WithCacheOnly(ctx), "testUnique", "TestString", value, &dst)
+		if err != nil || dst.TestString != value {
+			t.Fatalf("godscache.TestUniqueIndexValues: failed getting data by %q from cache: %v", value, err)
+		}
+
+		err = c.Delete(ctx, key)
+		if err != nil {
+			t.Fatalf("godscache.TestUniqueIndexValues: failed deleting %q from datastore and cache: %v", value, err)
+		}
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	c.SetUniqueIndex("testUnique", "TestString")
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testUnique", nil), &TestDbData{TestString: "a@example.com"})
+	if err != nil || key.Incomplete() {
+		t.Fatalf("godscache.TestUniqueIndex: failed putting data into datastore and cache: %v", err)
+	}
+
+	// The entity is found by its unique value, from the cache.
+	var dst TestDbData
+	err = c.GetBy(WithCacheOnly(ctx), "testUnique", "TestString", "a@example.com", &dst)
+	if err != nil || dst.TestString != "a@example.com" {
+		t.Fatalf("godscache.TestUniqueIndex: failed getting data by unique value from cache: %v: %+v", err, dst)
+	}
+
+	err = c.GetBy(ctx, "testUnique", "TestOther", "a@example.com", &dst)
+	if err == nil {
+		t.Fatalf("godscache.TestUniqueIndex: got data by a field which isn't unique")
+	}
+
+	// Another entity can't have the same value.
+	other := datastore.NameKey("testUnique", "other", nil)
+	_, err = c.Put(ctx, other, &TestDbData{TestString: "a@example.com"})
+	if !errors.Is(err, ErrNotUnique) {
+		t.Fatalf("godscache.TestUniqueIndex: expected ErrNotUnique, got %v", err)
+	}
+
+	// Changing the value releases the old one.
+	_, err = c.Put(ctx, key, &TestDbData{TestString: "b@example.com"})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndex: failed changing unique value: %v", err)
+	}
+
+	err = c.GetBy(ctx, "testUnique", "TestString", "a@example.com", &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestUniqueIndex: expected the old value to be released, got %v", err)
+	}
+
+	_, err = c.Put(ctx, other, &TestDbData{TestString: "a@example.com"})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndex: failed taking a released value: %v", err)
+	}
+
+	err = c.GetBy(ctx, "testUnique", "TestString", "a@example.com", &dst)
+	if err != nil || dst.TestString != "a@example.com" {
+		t.Fatalf("godscache.TestUniqueIndex: failed getting data by a value which was taken: %v", err)
+	}
+
+	// Deleting the entity releases its value.
+	err = c.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndex: failed deleting data from datastore and cache: %v", err)
+	}
+
+	err = c.GetBy(ctx, "testUnique", "TestString", "b@example.com", &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestUniqueIndex: expected a deleted entity's value to be released, got %v", err)
+	}
+
+	_, err = c.Put(ctx, datastore.IncompleteKey("testUnique", nil), &TestDbData{TestString: "b@example.com"})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndex: failed taking a deleted entity's value: %v", err)
+	}
+}
+
+func TestUniqueIndexNamespaces(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	c.SetUniqueIndex("testUnique", "TestString")
+
+	keyA := datastore.IncompleteKey("testUnique", nil)
+	keyA.Namespace = "tenantA"
+
+	keyA, err := c.Put(ctx, keyA, &TestDbData{TestString: "a@example.com"})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: failed putting data into datastore and cache: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.GetByNamespace(WithCacheOnly(ctx), "tenantA", "testUnique", "TestString", "a@example.com", &dst)
+	if err != nil || dst.TestString != "a@example.com" {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: failed getting data by unique value from cache: %v", err)
+	}
+
+	// Another namespace's value isn't found through the cache.
+	err = c.GetByNamespace(WithCacheOnly(ctx), "tenantB", "testUnique", "TestString", "a@example.com", &dst)
+	if err != ErrNotCached {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: expected ErrNotCached for another namespace, got: %v", err)
+	}
+
+	err = c.GetByNamespace(ctx, "tenantB", "testUnique", "TestString", "a@example.com", &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: expected datastore.ErrNoSuchEntity for another namespace, got: %v", err)
+	}
+
+	// The same value can be owned in each namespace.
+	keyB := datastore.IncompleteKey("testUnique", nil)
+	keyB.Namespace = "tenantB"
+
+	keyB, err = c.Put(ctx, keyB, &TestDbData{TestString: "a@example.com"})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: failed putting the same value in another namespace: %v", err)
+	}
+
+	err = c.Delete(ctx, keyA)
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: failed deleting data from datastore and cache: %v", err)
+	}
+
+	err = c.GetByNamespace(ctx, "tenantA", "testUnique", "TestString", "a@example.com", &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: expected the deleted entity's value to be released, got: %v", err)
+	}
+
+	err = c.GetByNamespace(ctx, "tenantB", "testUnique", "TestString", "a@example.com", &dst)
+	if err != nil || dst.TestString != "a@example.com" {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: failed getting data by unique value in another namespace: %v", err)
+	}
+
+	err = c.Delete(ctx, keyB)
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexNamespaces: failed deleting data from datastore and cache: %v", err)
+	}
+}
+
+// failingSelector is a memcache.ServerSelector which fails for the keys which fail says to.
+type failingSelector struct {
+	memcache.ServerList
+	fail func(key string) bool
+}
+
+func (s *failingSelector) PickServer(key string) (net.Addr, error) {
+	if s.fail(key) {
+		return nil, errors.New("godscache.failingSelector: failing on purpose")
+	}
+
+	return s.ServerList.PickServer(key)
+}
+
+func TestUniqueIndexCacheFailure(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	c.SetUniqueIndex("testUnique", "TestString")
+
+	// Caching the markers fails, but caching the entities doesn't.
+	markerKey := cacheKey(uniqueMarkerKey("", "testUnique", "TestString", "a@example.com"))
+	selector := &failingSelector{fail: func(key string) bool { return strings.HasPrefix(key, markerKey) }}
+
+	err := selector.SetServers(memcacheServers(ctx)...)
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexCacheFailure: failed setting memcached servers: %v", err)
+	}
+
+	working := c.MemcacheClient
+	c.MemcacheClient = memcache.NewFromSelector(selector)
+
+	// The write still succeeds, since it was committed.
+	key, err := c.Put(ctx, datastore.IncompleteKey("testUnique", nil), &TestDbData{TestString: "a@example.com"})
+	if err != nil || key == nil {
+		t.Fatalf("godscache.TestUniqueIndexCacheFailure: expected Put to succeed when caching the markers fails, got: %v, %v", key, err)
+	}
+
+	c.MemcacheClient = working
+
+	var dst TestDbData
+	err = c.GetBy(ctx, "testUnique", "TestString", "a@example.com", &dst)
+	if err != nil || dst.TestString != "a@example.com" {
+		t.Fatalf("godscache.TestUniqueIndexCacheFailure: failed getting data by unique value: %v", err)
+	}
+
+	c.MemcacheClient = memcache.NewFromSelector(selector)
+
+	err = c.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexCacheFailure: expected Delete to succeed when caching the markers fails, got: %v", err)
+	}
+
+	c.MemcacheClient = working
+
+	err = c.GetBy(ctx, "testUnique", "TestString", "a@example.com", &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestUniqueIndexCacheFailure: expected the deleted entity's value to be released, got: %v", err)
+	}
+}
+
+func TestUniqueIndexMulti(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	c.SetUniqueIndex("testUnique", "TestString")
+
+	keys := []*datastore.Key{
+		datastore.NameKey("testUnique", "a", nil),
+		datastore.NameKey("testUnique", "b", nil),
+	}
+
+	// Entities in the same batch can't have the same value.
+	_, err := c.PutMulti(ctx, keys, []TestDbData{{TestString: "x"}, {TestString: "x"}})
+	if !errors.Is(err, ErrNotUnique) {
+		t.Fatalf("godscache.TestUniqueIndexMulti: expected ErrNotUnique, got %v", err)
+	}
+
+	_, err = c.PutMulti(ctx, keys, []TestDbData{{TestString: "x"}, {TestString: "y"}})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexMulti: failed putting data into datastore and cache: %v", err)
+	}
+
+	// Entities in the same batch can swap values.
+	_, err = c.PutMulti(ctx, keys, []*TestDbData{{TestString: "y"}, {TestString: "x"}})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexMulti: failed swapping unique values: %v", err)
+	}
+
+	var dst TestDbData
+	err = c.GetBy(ctx, "testUnique", "TestString", "x", &dst)
+	if err != nil || dst.TestString != "x" {
+		t.Fatalf("godscache.TestUniqueIndexMulti: failed getting data by unique value: %v: %+v", err, dst)
+	}
+
+	// Values are unique within a namespace.
+	nsKey := datastore.NameKey("testUnique", "a", nil)
+	nsKey.Namespace = "testNamespace"
+
+	_, err = c.Put(ctx, nsKey, &TestDbData{TestString: "x"})
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexMulti: failed putting data into a namespace: %v", err)
+	}
+
+	err = c.GetByNamespace(ctx, "testNamespace", "testUnique", "TestString", "x", &dst)
+	if err != nil || dst.TestString != "x" {
+		t.Fatalf("godscache.TestUniqueIndexMulti: failed getting data by unique value in a namespace: %v", err)
+	}
+
+	err = c.DeleteMulti(ctx, append(keys, nsKey))
+	if err != nil {
+		t.Fatalf("godscache.TestUniqueIndexMulti: failed deleting data from datastore and cache: %v", err)
+	}
+
+	err = c.GetBy(ctx, "testUnique", "TestString", "y", &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestUniqueIndexMulti: expected deleted entities' values to be released, got %v", err)
+	}
+}
+
+type TestRefTeam struct {
+	Name string
+}
+
+type TestRefAuthor struct {
+	Name    string
+	TeamKey *datastore.Key `godscache:"ref=Team"`
+	Team    TestRefTeam    `datastore:"-" json:"-"`
+}
+
+type TestRefPost struct {
+	Title     string
+	AuthorKey *datastore.Key   `godscache:"ref=Author"`
+	Author    *TestRefAuthor   `datastore:"-" json:"-"`
+	TeamKeys  []*datastore.Key `godscache:"ref=Teams"`
+	Teams     []*TestRefTeam   `datastore:"-" json:"-"`
+}
+
+func TestGetMultiWithRefs(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+
+	dsClient, err := datastore.NewClient(ctx, os.Getenv("GODSCACHE_PROJECT_ID"))
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiWithRefs: instantiating new datastore client failed: %v", err)
+	}
+
+	store := &recordingStore{Store: NewDatastoreStore(dsClient)}
+
+	c, err := NewClientWithStore(ctx, os.Getenv("GODSCACHE_PROJECT_ID"), store)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiWithRefs: instantiating new Client struct with a custom store failed: %v", err)
+	}
+	defer c.Close()
+
+	teamKey := datastore.NameKey("testRefTeam", "team", nil)
+	authorKey := datastore.NameKey("testRefAuthor", "author", nil)
+	postKeys := []*datastore.Key{
+		datastore.NameKey("testRefPost", "post1", nil),
+		datastore.NameKey("testRefPost", "post2", nil),
+	}
+
+	_, err = c.Put(ctx, teamKey, &TestRefTeam{Name: "team"})
+	if err == nil {
+		_, err = c.Put(ctx, authorKey, &TestRefAuthor{Name: "author", TeamKey: teamKey})
+	}
+	if err == nil {
+		_, err = c.PutMulti(ctx, postKeys, []*TestRefPost{
+			{Title: "post1", AuthorKey: authorKey, TeamKeys: []*datastore.Key{teamKey, datastore.NameKey("testRefTeam", "missing", nil)}},
+			{Title: "post2", AuthorKey: authorKey},
+		})
+	}
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiWithRefs: failed putting data into datastore and cache: %v", err)
+	}
+
+	// Each level is got with one batched request.
+	for _, key := range append([]*datastore.Key{teamKey, authorKey}, postKeys...) {
+		err = c.deleteFromCache(key)
+		if err != nil {
+			t.Fatalf("godscache.TestGetMultiWithRefs: failed deleting data from cache: %v", err)
+		}
+	}
+
+	posts := make([]TestRefPost, len(postKeys))
+	err = c.GetMultiWithRefs(ctx, postKeys, posts, 2)
+	if err != nil {
+		t.Fatalf("godscache.TestGetMultiWithRefs: failed getting data with refs: %v", err)
+	}
+
+	// The team is cached when it's loaded for post1's teams, so the author's team is got from
+	// the cache.
+	if store.getMultis != 2 || store.gets != 0 {
+		t.Fatalf("godscache.TestGetMultiWithRefs: expected 2 batched datastore requests, got %v batched and %v single", store.getMultis, store.gets)
+	}
+
+	for _, post := range posts {
+		if post.Author == nil || post.Author.Name != "author" || post.Author.Team.Name != "team" {
+			t.Fatalf("godscache.TestGetMultiWithRefs: refs weren't loaded: %+v", post)
+		}
+	}
+
+	if posts[0].Author != posts[1].Author {
+		t.Fatalf("godscache.TestGetMultiWithRefs: expected one author to be loaded for both posts")
+	}
+
+	if len(posts[0].Teams) != 2 || posts[0].Teams[0] == nil || posts[0].Teams[0].Name != "team" || posts[0].Teams[1] != nil {
+		t.Fatalf("godscache.TestGetMultiWithRefs: slice refs weren't loaded: %+v", posts[0].Teams)
+	}
+
+	// Refs are only followed to the given depth, and they're now cached.
+	var post TestRefPost
+	err = c.GetWithRefs(WithCacheOnly(ctx), postKeys[1], &post, 1)
+	if err != nil || post.Author == nil || post.Author.Team.Name != "" {
+		t.Fatalf("godscache.TestGetMultiWithRefs: failed getting data with refs to depth 1 from cache: %v: %+v", err, post)
+	}
+}
+
+type TestDbDataVersioned struct {
+	TestCount int
+	Version   int64 `godscache:"version"`
+}
+
+func TestUpdate(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	key, err := c.Put(ctx, datastore.IncompleteKey("testUpdate", nil), &TestDbDataVersioned{})
+	if err != nil {
+		t.Fatalf("godscache.TestUpdate: failed putting data into datastore and cache: %v", err)
+	}
+
+	// Concurrent updates are retried, so none of them are lost.
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			var dst TestDbDataVersioned
+			errs[idx] = c.Update(ctx, key, &dst, func() error {
+				dst.TestCount++
+				return nil
+			}, datastore.MaxAttempts(100))
+		}(idx)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("godscache.TestUpdate: failed updating data: %v", err)
+		}
+	}
+
+	// Updates invalidate the cache, so the last update is read from the datastore.
+	var dst TestDbDataVersioned
+	err = c.Get(WithCacheOnly(ctx), key, &dst)
+	if err != ErrNotCached {
+		t.Fatalf("godscache.TestUpdate: expected the updated entity not to be cached, got %v", err)
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestCount != len(errs) || dst.Version != int64(len(errs)) {
+		t.Fatalf("godscache.TestUpdate: expected count and version %v, got %v: %+v", len(errs), err, dst)
+	}
+
+	// An update from a version which isn't the latest fails.
+	stale := TestDbDataVersioned{Version: 1}
+	err = c.Update(ctx, key, &stale, func() error {
+		stale.TestCount = 0
+		return nil
+	})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("godscache.TestUpdate: expected ErrVersionConflict, got %v", err)
+	}
+
+	// An update from the latest version succeeds.
+	err = c.Update(ctx, key, &dst, func() error {
+		dst.TestCount = 0
+		return nil
+	})
+	if err != nil || dst.Version != int64(len(errs))+1 {
+		t.Fatalf("godscache.TestUpdate: failed updating data from the latest version: %v: %+v", err, dst)
+	}
+
+	// Errors from f are returned as they are, and nothing is put.
+	errAbort := errors.New("abort")
+	err = c.Update(ctx, key, &dst, func() error {
+		dst.TestCount = 100
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("godscache.TestUpdate: expected the error from f, got %v", err)
+	}
+
+	err = c.Get(WithNoCache(ctx), key, &dst)
+	if err != nil || dst.TestCount != 0 {
+		t.Fatalf("godscache.TestUpdate: data was put after f failed: %v: %+v", err, dst)
+	}
+
+	// Retries get the entity into a zero value, so a PropertyList doesn't collect duplicate
+	// properties.
+	var props datastore.PropertyList
+	attempts := 0
+	err = c.Update(ctx, key, &props, func() error {
+		attempts++
+		if attempts > 1 {
+			return nil
+		}
+
+		// A write between the transaction's read and its commit makes it retry.
+		_, err := c.Store.Put(ctx, key, &TestDbDataVersioned{TestCount: 5, Version: dst.Version})
+		return err
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("godscache.TestUpdate: failed retrying an update of a PropertyList after %v attempts: %v", attempts, err)
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestCount != 5 {
+		t.Fatalf("godscache.TestUpdate: expected the retried update's data, got %v: %+v", err, dst)
+	}
+
+	err = c.Update(ctx, datastore.NameKey("testUpdate", "missing", nil), &dst, func() error { return nil })
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Fatalf("godscache.TestUpdate: expected datastore.ErrNoSuchEntity, got %v", err)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	resetEmulator(t)
+
+	ctx := context.Background()
+	c := newTestClient(t)
+	key := putTestEntity(t, c, "TestMutate 1")
+	c.LocalCacheSize = 10
+
+	deleted, err := c.Put(ctx, datastore.NameKey("testMutate", "deleted", nil), &TestDbData{TestString: "TestMutate deleted"})
+	if err != nil {
+		t.Fatalf("godscache.TestMutate: failed putting data into datastore and cache: %v", err)
+	}
+
+	for _, k := range []*datastore.Key{key, deleted} {
+		var dst TestDbData
+		err = c.Get(ctx, k, &dst)
+		if err != nil {
+			t.Fatalf("godscache.TestMutate: failed getting data from datastore or cache: %v", err)
+		}
+	}
+
+	keys, err := c.Mutate(ctx,
+		NewUpdate(key, &TestDbData{TestString: "TestMutate 2"}),
+		NewInsert(datastore.IncompleteKey("testMutate", nil), &TestDbData{TestString: "TestMutate inserted"}),
+		NewDelete(deleted),
+	)
+	if err != nil {
+		t.Fatalf("godscache.TestMutate: failed applying mutations: %v", err)
+	}
+	defer c.Delete(ctx, keys[1])
+
+	if len(keys) != 3 || !keys[0].Equal(key) || keys[1].Incomplete() || !keys[2].Equal(deleted) {
+		t.Fatalf("godscache.TestMutate: unexpected keys returned: %v", keys)
+	}
+
+	// The written entities are no longer cached, and the deleted one has a tombstone.
+	var dst TestDbData
+	for _, k := range keys[:2] {
+		err = c.Get(WithCacheOnly(ctx), k, &dst)
+		if err != ErrNotCached {
+			t.Fatalf("godscache.TestMutate: expected %v not to be cached, got %v", k, err)
+		}
+	}
+
+	item, err := c.MemcacheClient.Get(cacheKey(deleted))
+	if err != nil || !isTombstone(item.Value) {
+		t.Fatalf("godscache.TestMutate: expected a tombstone for the deleted data: %v", err)
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestString != "TestMutate 2" {
+		t.Fatalf("godscache.TestMutate: expected the updated data, got %v: %+v", err, dst)
+	}
+
+	err = c.Get(ctx, keys[1], &dst)
+	if err != nil || dst.TestString != "TestMutate inserted" {
+		t.Fatalf("godscache.TestMutate: expected the inserted data, got %v: %+v", err, dst)
+	}
+
+	err = c.Get(ctx, deleted, &dst)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatalf("godscache.TestMutate: expected datastore.ErrNoSuchEntity for the deleted data, got %v", err)
+	}
+
+	// If the mutations fail, the tombstones are removed again, since nothing was deleted.
+	_, err = c.Mutate(ctx,
+		NewUpdate(datastore.NameKey("testMutate", "missing", nil), &TestDbData{TestString: "TestMutate missing"}),
+		NewDelete(key),
+	)
+	if err == nil {
+		t.Fatalf("godscache.TestMutate: updating an entity which doesn't exist succeeded")
+	}
+
+	err = c.Get(ctx, key, &dst)
+	if err != nil || dst.TestString != "TestMutate 2" {
+		t.Fatalf("godscache.TestMutate: expected the data which failed to be deleted, got %v: %+v", err, dst)
+	}
+
+	// Entities with unique fields can't be written with Mutate.
+	c.SetUniqueIndex("testMutateUnique", "TestString")
+
+	_, err = c.Mutate(ctx, NewInsert(datastore.IncompleteKey("testMutateUnique", nil), &TestDbData{TestString: "a@example.com"}))
+	if err == nil {
+		t.Fatalf("godscache.TestMutate: writing an entity with a unique field succeeded")
+	}
+}
+
 // ----- End Tests -----
 
 // ----- Benchmarks -----
@@ -1877,7 +5374,7 @@ func ExampleClient_DeleteMulti() {
 		return
 	}
 
-	// Output: godscache.ExampleClient_DeleteMulti: failed getting results from datastore or cache: godscache.Client.GetMulti: failed getting multiple values from datastore: datastore: no such entity (and 1 other error)
+	// Output: godscache.ExampleClient_DeleteMulti: failed getting results from datastore or cache: datastore: no such entity (and 1 other error)
 }
 
 func ExampleClient_Run() {
@@ -0,0 +1,122 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// DefaultCompressionThreshold is the size in bytes above which cached values are compressed,
+// unless the Client's CompressionThreshold says otherwise.
+const DefaultCompressionThreshold = 1024
+
+// Cached values begin with a two byte header: valueMagic, followed by a byte of flags saying how
+// the rest of the value is encoded. Values written by older versions of godscache have no header,
+// and are plain JSON. Since JSON can't begin with valueMagic, the two are easy to tell apart.
+// Values without an envelope are always treated as cache misses, since there's no way to tell
+// what type they were cached from.
+const (
+	valueMagic byte = 0xd5
+
+	// flagCompressed marks a value which is compressed with snappy.
+	flagCompressed byte = 1 << 0
+
+	valueHeaderLen = 2
+)
+
+// encodeValue turns the JSON encoding of an entity of type t into the value to store in the cache
+// under key. It wraps it in an envelope, compresses it if it's larger than the client's compression
+// threshold, and encrypts it if the client has a key provider.
+func (c *Client) encodeValue(key string, t reflect.Type, data []byte) ([]byte, error) {
+	flags := flagEnvelope
+	data = wrapEnvelope(t, data, time.Now())
+
+	if c.CompressionThreshold >= 0 && len(data) > c.CompressionThreshold {
+		compressed := snappy.Encode(nil, data)
+
+		// Only keep the compressed data if compressing it made it smaller.
+		if len(compressed) < len(data) {
+			data = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	if c.Encryption != nil {
+		flags |= flagEncrypted
+
+		value, err := c.encrypt(key, []byte{valueMagic, flags}, data)
+		if err != nil {
+			return nil, fmt.Errorf("godscache.Client.encodeValue: failed encrypting value: %v", err)
+		}
+
+		return value, nil
+	}
+
+	value := make([]byte, 0, valueHeaderLen+len(data))
+	value = append(value, valueMagic, flags)
+	value = append(value, data...)
+
+	return value, nil
+}
+
+// decodeValue turns a value from the cache under key back into the envelope holding the JSON
+// encoding of an entity of type t. It understands compressed and uncompressed values. Values
+// without an envelope, or with an envelope made for another type, are rejected with an error
+// wrapping errSchemaMismatch. If the client has a key provider, values which aren't encrypted,
+// or which fail to decrypt, are rejected with an error wrapping errUndecryptable, since anyone
+// with access to memcached could have written them.
+func (c *Client) decodeValue(key string, t reflect.Type, value []byte) (*envelope, error) {
+	// Values without a header are plain JSON, without an envelope.
+	if len(value) == 0 || value[0] != valueMagic {
+		if c.Encryption != nil {
+			return nil, fmt.Errorf("godscache.Client.decodeValue: %w: it isn't encrypted", errUndecryptable)
+		}
+
+		return nil, fmt.Errorf("godscache.Client.decodeValue: %w: it has no envelope", errSchemaMismatch)
+	}
+
+	if len(value) < valueHeaderLen {
+		return nil, errors.New("godscache.Client.decodeValue: cached value is too short to have a header")
+	}
+
+	header, flags, data := value[:valueHeaderLen], value[1], value[valueHeaderLen:]
+
+	if flags&^(flagCompressed|flagEncrypted|flagEnvelope) != 0 {
+		return nil, fmt.Errorf("godscache.Client.decodeValue: cached value has unknown flags: %#x", flags)
+	}
+
+	if flags&flagEncrypted != 0 {
+		decrypted, err := c.decrypt(key, header, data)
+		if err != nil {
+			return nil, fmt.Errorf("godscache.Client.decodeValue: %w", err)
+		}
+		data = decrypted
+	} else if c.Encryption != nil {
+		return nil, fmt.Errorf("godscache.Client.decodeValue: %w: it isn't encrypted", errUndecryptable)
+	}
+
+	if flags&flagEnvelope == 0 {
+		return nil, fmt.Errorf("godscache.Client.decodeValue: %w: it has no envelope", errSchemaMismatch)
+	}
+
+	if flags&flagCompressed != 0 {
+		decompressed, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("godscache.Client.decodeValue: failed decompressing cached value: %v", err)
+		}
+		data = decompressed
+	}
+
+	e, err := unwrapEnvelope(t, data)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.decodeValue: %w", err)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Collection is a typed view of the entities of one kind, which are stored as values of type T.
+// It uses the Client's cache, with the caching settings of its kind, and it refuses keys of
+// other kinds. Make one with NewCollection.
+type Collection[T any] struct {
+	client *Client
+	kind   string
+}
+
+// NewCollection makes a Collection for the entities of the given kind, which are stored as values
+// of type T.
+func NewCollection[T any](c *Client, kind string) *Collection[T] {
+	return &Collection[T]{
+		client: c,
+		kind:   kind,
+	}
+}
+
+// Kind returns the kind of the collection's entities.
+func (col *Collection[T]) Kind() string {
+	return col.kind
+}
+
+// Client returns the Client the collection uses.
+func (col *Collection[T]) Client() *Client {
+	return col.client
+}
+
+// Policy returns the caching settings for the collection's kind.
+func (col *Collection[T]) Policy() KindPolicy {
+	return col.client.KindPolicy(col.kind)
+}
+
+// SetPolicy sets the caching settings for the collection's kind. It affects every Collection and
+// Client call for the kind, since they share the Client's settings.
+func (col *Collection[T]) SetPolicy(policy KindPolicy) {
+	col.client.SetKindPolicy(col.kind, policy)
+}
+
+// IncompleteKey returns an incomplete key of the collection's kind.
+func (col *Collection[T]) IncompleteKey(parent *datastore.Key) *datastore.Key {
+	return datastore.IncompleteKey(col.kind, parent)
+}
+
+// IDKey returns a key of the collection's kind with the given ID.
+func (col *Collection[T]) IDKey(id int64, parent *datastore.Key) *datastore.Key {
+	return datastore.IDKey(col.kind, id, parent)
+}
+
+// NameKey returns a key of the collection's kind with the given name.
+func (col *Collection[T]) NameKey(name string, parent *datastore.Key) *datastore.Key {
+	return datastore.NameKey(col.kind, name, parent)
+}
+
+// Query returns a new query for the collection's kind.
+func (col *Collection[T]) Query() *datastore.Query {
+	return datastore.NewQuery(col.kind)
+}
+
+// Get gets the entity for key from the cache or datastore.
+func (col *Collection[T]) Get(ctx context.Context, key *datastore.Key) (*T, error) {
+	err := col.checkKeys("Get", key)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := new(T)
+
+	err = col.client.Get(ctx, key, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// GetMulti gets the entities for keys from the cache or datastore, in the order of the keys. If
+// some of them can't be got, such as because they don't exist, the others are still returned,
+// along with a datastore.MultiError holding the error for each entity at the same position, and
+// the entities which couldn't be got are nil.
+func (col *Collection[T]) GetMulti(ctx context.Context, keys []*datastore.Key) ([]*T, error) {
+	err := col.checkKeys("GetMulti", keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := make([]*T, len(keys))
+
+	err = col.client.GetMulti(ctx, keys, dst)
+	if errs, ok := err.(datastore.MultiError); ok {
+		for idx, err := range errs {
+			if err != nil {
+				dst[idx] = nil
+			}
+		}
+
+		return dst, errs
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// Put puts src into the datastore and cache under key, and returns the complete key.
+func (col *Collection[T]) Put(ctx context.Context, key *datastore.Key, src *T) (*datastore.Key, error) {
+	err := col.checkKeys("Put", key)
+	if err != nil {
+		return nil, err
+	}
+
+	return col.client.Put(ctx, key, src)
+}
+
+// PutMulti puts src into the datastore and cache under keys, and returns the complete keys.
+func (col *Collection[T]) PutMulti(ctx context.Context, keys []*datastore.Key, src []*T) ([]*datastore.Key, error) {
+	err := col.checkKeys("PutMulti", keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	return col.client.PutMulti(ctx, keys, src)
+}
+
+// Delete deletes the entity for key from the datastore and cache.
+func (col *Collection[T]) Delete(ctx context.Context, key *datastore.Key) error {
+	err := col.checkKeys("Delete", key)
+	if err != nil {
+		return err
+	}
+
+	return col.client.Delete(ctx, key)
+}
+
+// DeleteMulti deletes the entities for keys from the datastore and cache.
+func (col *Collection[T]) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	err := col.checkKeys("DeleteMulti", keys...)
+	if err != nil {
+		return err
+	}
+
+	return col.client.DeleteMulti(ctx, keys)
+}
+
+// Run runs a query, which should be made with Query so that it's for the collection's kind.
+// Like Client.Run, it isn't cached.
+func (col *Collection[T]) Run(ctx context.Context, q *datastore.Query) *CollectionIterator[T] {
+	return &CollectionIterator[T]{it: col.client.RunStore(ctx, q)}
+}
+
+// checkKeys returns an error if any of keys is nil, or isn't of the collection's kind.
+func (col *Collection[T]) checkKeys(method string, keys ...*datastore.Key) error {
+	for _, key := range keys {
+		if key == nil {
+			return fmt.Errorf("godscache.Collection.%v: you provided a nil key", method)
+		}
+
+		if key.Kind != col.kind {
+			return fmt.Errorf("godscache.Collection.%v: key %v isn't of the collection's kind %q", method, key, col.kind)
+		}
+	}
+
+	return nil
+}
+
+// CollectionIterator is the typed result of running a query on a Collection.
+type CollectionIterator[T any] struct {
+	it Iterator
+}
+
+// Next returns the next result and its key. When there are no more results, the error is
+// iterator.Done. For keys-only queries, the result is left empty.
+func (it *CollectionIterator[T]) Next() (*T, *datastore.Key, error) {
+	dst := new(T)
+
+	key, err := it.it.Next(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dst, key, nil
+}
+
+// Cursor returns a cursor for the iterator's current location.
+func (it *CollectionIterator[T]) Cursor() (datastore.Cursor, error) {
+	return it.it.Cursor()
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"google.golang.org/api/option"
+)
+
+const (
+	// DefaultEmulatorMemcacheServer is the memcached server used by NewEmulatorClient if no
+	// other memcached servers are specified.
+	DefaultEmulatorMemcacheServer = "localhost:11211"
+
+	// DefaultEmulatorProjectID is the project ID used by NewEmulatorClient if none is specified.
+	// The emulator accepts any project ID.
+	DefaultEmulatorProjectID = "dummy-emulator-datastore-project"
+)
+
+// EmulatorHost returns the address of the gcloud Datastore emulator from the
+// DATASTORE_EMULATOR_HOST environment variable, or an empty string if it isn't set. When it's
+// set, the datastore clients made by NewClient connect to the emulator instead of to Google
+// Cloud. You can get the right value for it from the command:
+// gcloud beta emulators datastore env-init
+func EmulatorHost() string {
+	return os.Getenv("DATASTORE_EMULATOR_HOST")
+}
+
+// NewEmulatorClient is a constructor for making a new godscache client which uses the gcloud
+// Datastore emulator and a local memcached server, for development and integration tests. The
+// DATASTORE_EMULATOR_HOST environment variable must be set. If projectID is empty, it's taken
+// from the DATASTORE_PROJECT_ID environment variable, or DefaultEmulatorProjectID is used. The
+// memcached servers are specified the same way as for NewClient, but if none are specified,
+// DefaultEmulatorMemcacheServer is used.
+func NewEmulatorClient(ctx context.Context, projectID string, opts ...option.ClientOption) (*Client, error) {
+	if EmulatorHost() == "" {
+		return nil, errors.New("godscache.NewEmulatorClient: the DATASTORE_EMULATOR_HOST environment variable isn't set")
+	}
+
+	if projectID == "" {
+		projectID = os.Getenv("DATASTORE_PROJECT_ID")
+	}
+	if projectID == "" {
+		projectID = DefaultEmulatorProjectID
+	}
+
+	if memcacheServers(ctx) == nil {
+		ctx = context.WithValue(ctx, MemcacheServerKey, []string{DefaultEmulatorMemcacheServer})
+	}
+
+	c, err := NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.NewEmulatorClient: failed creating client for the datastore emulator: %v", err)
+	}
+
+	return c, nil
+}
+
+// ResetEmulator deletes all the data in the datastore emulator and in the client's memcached
+// servers, so that each test can start from a clean slate. To avoid wiping out real data by
+// mistake, it fails unless the DATASTORE_EMULATOR_HOST environment variable is set.
+func (c *Client) ResetEmulator(ctx context.Context) error {
+	host := EmulatorHost()
+	if host == "" {
+		return errors.New("godscache.Client.ResetEmulator: refusing to reset, because the DATASTORE_EMULATOR_HOST environment variable isn't set")
+	}
+
+	// Ask the emulator to delete all its data.
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(host, "/")+"/reset", nil)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.ResetEmulator: failed making reset request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.ResetEmulator: failed resetting datastore emulator: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("godscache.Client.ResetEmulator: failed resetting datastore emulator: %v", resp.Status)
+	}
+
+	// Flush every memcached server, not just the one DeleteAll would pick.
+	for _, server := range c.MemcacheServers {
+		err = memcache.New(server).DeleteAll()
+		if err != nil {
+			return fmt.Errorf("godscache.Client.ResetEmulator: failed deleting all data from memcached server %v: %v", server, err)
+		}
+	}
+
+	return nil
+}
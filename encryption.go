@@ -0,0 +1,177 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// KeyProvider supplies the AES keys used to encrypt cached values. Each key has an ID, which is
+// stored in the header of every value encrypted with it, so that keys can be rotated without
+// making the values already in the cache unreadable. Keys must be 16, 24 or 32 bytes long, to
+// select AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key to encrypt new values with.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the value of the key with the given ID, to decrypt values with. It returns
+	// an error if there is no such key, for example because it's been retired.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider with a fixed set of keys. To rotate keys, make a new one with
+// the new key as the current key, and keep the old key in it until the values encrypted with it
+// have expired from the cache.
+type StaticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticKeyProvider makes a StaticKeyProvider which encrypts with the key called current, and
+// can decrypt with any of keys, which are indexed by ID.
+func NewStaticKeyProvider(current string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("godscache.NewStaticKeyProvider: the current key %q isn't in keys", current)
+	}
+
+	p := &StaticKeyProvider{
+		current: current,
+		keys:    make(map[string][]byte, len(keys)),
+	}
+
+	for id, key := range keys {
+		if len(id) > maxKeyIDLen {
+			return nil, fmt.Errorf("godscache.NewStaticKeyProvider: key ID %q is longer than %v bytes", id, maxKeyIDLen)
+		}
+
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("godscache.NewStaticKeyProvider: key %q is %v bytes, but it must be 16, 24 or 32 bytes", id, len(key))
+		}
+
+		p.keys[id] = append([]byte(nil), key...)
+	}
+
+	return p, nil
+}
+
+// CurrentKey returns the ID and value of the key to encrypt new values with.
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+// Key returns the value of the key with the given ID.
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("godscache.StaticKeyProvider.Key: unknown key ID %q", id)
+	}
+
+	return key, nil
+}
+
+// flagEncrypted marks a value which is encrypted with AES-GCM. The encrypted data is preceded by
+// the length of the key ID in one byte, the key ID, and the nonce.
+const flagEncrypted byte = 1 << 2
+
+// maxKeyIDLen is the longest key ID which fits in an encrypted value's header.
+const maxKeyIDLen = 255
+
+// errUndecryptable is returned when decoding a cached value which can't be decrypted and
+// authenticated. Such values are treated as cache misses, and are evicted from the cache.
+var errUndecryptable = errors.New("cached value can't be decrypted")
+
+// encrypt encrypts data, which is the payload of a value with the given header, with the current
+// key from the client's key provider. The memcache key and the header are authenticated along
+// with the data, so an encrypted value can't be moved to another key or have its flags changed.
+func (c *Client) encrypt(key string, header []byte, data []byte) ([]byte, error) {
+	id, aesKey, err := c.Encryption.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.encrypt: failed getting current encryption key: %v", err)
+	}
+
+	if len(id) > maxKeyIDLen {
+		return nil, fmt.Errorf("godscache.Client.encrypt: key ID %q is longer than %v bytes", id, maxKeyIDLen)
+	}
+
+	aead, err := newAEAD(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.encrypt: %v", err)
+	}
+
+	value := make([]byte, 0, len(header)+1+len(id)+aead.NonceSize()+len(data)+aead.Overhead())
+	value = append(value, header...)
+	value = append(value, byte(len(id)))
+	value = append(value, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.encrypt: failed making nonce: %v", err)
+	}
+
+	additional := append([]byte(key), value...)
+	value = append(value, nonce...)
+
+	return aead.Seal(value, nonce, data, additional), nil
+}
+
+// decrypt decrypts the payload of an encrypted value with the given header, returning an error
+// wrapping errUndecryptable if it can't be decrypted and authenticated.
+func (c *Client) decrypt(key string, header []byte, data []byte) ([]byte, error) {
+	if c.Encryption == nil {
+		return nil, fmt.Errorf("godscache.Client.decrypt: %w: there's no key provider", errUndecryptable)
+	}
+
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, fmt.Errorf("godscache.Client.decrypt: %w: the key ID is cut off", errUndecryptable)
+	}
+
+	idLen := 1 + int(data[0])
+	id := string(data[1:idLen])
+
+	aesKey, err := c.Encryption.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.decrypt: %w: failed getting key %q: %v", errUndecryptable, id, err)
+	}
+
+	aead, err := newAEAD(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.decrypt: %w: %v", errUndecryptable, err)
+	}
+
+	if len(data) < idLen+aead.NonceSize() {
+		return nil, fmt.Errorf("godscache.Client.decrypt: %w: the nonce is cut off", errUndecryptable)
+	}
+
+	additional := append(append([]byte(key), header...), data[:idLen]...)
+	nonce, ciphertext := data[idLen:idLen+aead.NonceSize()], data[idLen+aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.Client.decrypt: %w: %v", errUndecryptable, err)
+	}
+
+	return plaintext, nil
+}
+
+// newAEAD makes an AES-GCM cipher with the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed making AES cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed making GCM cipher: %v", err)
+	}
+
+	return aead, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The JSON encoding of every cached entity is wrapped in an envelope, which records the version
+// of the envelope format, a fingerprint of the Go type the entity was cached from, and when it
+// was cached. The envelope is a version byte, followed by the fingerprint and the write time in
+// unix nanoseconds, both as 8 byte big-endian integers, followed by the JSON.
+const (
+	envelopeVersion byte = 1
+
+	envelopeLen = 1 + 8 + 8
+
+	// flagEnvelope marks a value whose payload is wrapped in an envelope.
+	flagEnvelope byte = 1 << 3
+)
+
+// errSchemaMismatch is returned when decoding a cached value which wasn't cached from the type
+// it's being decoded into, or which can't be checked because it has no envelope. Such values are
+// treated as cache misses, so they're refreshed from the datastore.
+var errSchemaMismatch = errors.New("cached value doesn't match the destination type")
+
+// envelope is an unwrapped cache envelope.
+type envelope struct {
+	fingerprint uint64
+	written     time.Time
+	data        []byte
+}
+
+// wrapEnvelope wraps the JSON encoding of an entity of type t in an envelope.
+func wrapEnvelope(t reflect.Type, data []byte, written time.Time) []byte {
+	wrapped := make([]byte, 0, envelopeLen+len(data))
+	wrapped = append(wrapped, envelopeVersion)
+	wrapped = binary.BigEndian.AppendUint64(wrapped, fingerprint(t))
+	wrapped = binary.BigEndian.AppendUint64(wrapped, uint64(written.UnixNano()))
+	wrapped = append(wrapped, data...)
+
+	return wrapped
+}
+
+// unwrapEnvelope unwraps the envelope around the JSON encoding of an entity, returning an error
+// wrapping errSchemaMismatch if the envelope has a different version, or wasn't made for type t.
+func unwrapEnvelope(t reflect.Type, wrapped []byte) (*envelope, error) {
+	if len(wrapped) < envelopeLen {
+		return nil, errors.New("godscache.unwrapEnvelope: cached value is too short to have an envelope")
+	}
+
+	if wrapped[0] != envelopeVersion {
+		return nil, fmt.Errorf("godscache.unwrapEnvelope: %w: envelope version %v isn't %v", errSchemaMismatch, wrapped[0], envelopeVersion)
+	}
+
+	e := &envelope{
+		fingerprint: binary.BigEndian.Uint64(wrapped[1:9]),
+		written:     time.Unix(0, int64(binary.BigEndian.Uint64(wrapped[9:17]))),
+		data:        wrapped[envelopeLen:],
+	}
+
+	if want := fingerprint(t); e.fingerprint != want {
+		return nil, fmt.Errorf("godscache.unwrapEnvelope: %w: fingerprint %#x isn't %#x for %v", errSchemaMismatch, e.fingerprint, want, t)
+	}
+
+	return e, nil
+}
+
+// fingerprints caches the fingerprints of types, indexed by reflect.Type.
+var fingerprints sync.Map
+
+// fingerprint returns a hash of the name of type t, and of the names, types and tags of its fields,
+// so that any change to the shape of an entity's type changes its fingerprint. Pointers are
+// followed, so T and *T have the same fingerprint.
+func fingerprint(t reflect.Type) uint64 {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if f, ok := fingerprints.Load(t); ok {
+		return f.(uint64)
+	}
+
+	var b strings.Builder
+	describeType(&b, t, make(map[reflect.Type]bool))
+
+	h := fnv.New64a()
+	h.Write([]byte(b.String()))
+	f := h.Sum64()
+
+	fingerprints.Store(t, f)
+
+	return f
+}
+
+// describeType writes a description of type t to b, for fingerprinting it. Types which have
+// already been described are only described by name, so recursive types don't recurse forever.
+func describeType(b *strings.Builder, t reflect.Type, seen map[reflect.Type]bool) {
+	if t == nil {
+		b.WriteString("nil")
+		return
+	}
+
+	b.WriteString(t.PkgPath())
+	b.WriteString(".")
+	b.WriteString(t.String())
+
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Struct:
+		b.WriteString("{")
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fmt.Fprintf(b, "%v %q ", field.Name, field.Tag)
+			describeType(b, field.Type, seen)
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		b.WriteString("[")
+		describeType(b, t.Elem(), seen)
+		b.WriteString("]")
+
+	case reflect.Map:
+		b.WriteString("[")
+		describeType(b, t.Key(), seen)
+		b.WriteString("]")
+		describeType(b, t.Elem(), seen)
+	}
+}
@@ -0,0 +1,968 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscachetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Datastore is an in-memory fake of the Cloud Datastore service. It serves the Datastore gRPC API
+// on a loopback port for a single project, and supports lookups, commits, ID allocation,
+// transactions with optimistic concurrency control, and simple queries.
+type Datastore struct {
+	pb.UnimplementedDatastoreServer
+
+	projectID  string
+	listener   net.Listener
+	server     *grpc.Server
+	httpServer *http.Server
+
+	mu       sync.Mutex
+	entities map[string]*storedEntity
+	updated  map[string]int64
+	txns     map[string]*transaction
+	version  int64
+	nextID   int64
+	nextTxn  int64
+}
+
+// storedEntity is an entity saved in the fake datastore, along with the version of the commit
+// which last wrote it.
+type storedEntity struct {
+	entity  *pb.Entity
+	version int64
+}
+
+// transaction is an open transaction. It remembers the datastore version it started at and the
+// keys it has read, so that commits can detect conflicting writes.
+type transaction struct {
+	readOnly bool
+	start    int64
+	reads    map[string]bool
+}
+
+// NewDatastore starts a fake datastore serving projectID on a random loopback port.
+// Requests for any other project fail the same way they do against the real service.
+func NewDatastore(projectID string) (*Datastore, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("godscachetest.NewDatastore: failed listening on loopback: %v", err)
+	}
+
+	split := newSplitListener(lis)
+
+	d := &Datastore{
+		projectID: projectID,
+		listener:  lis,
+		server:    grpc.NewServer(),
+	}
+	d.Reset()
+
+	d.httpServer = &http.Server{Handler: d.emulatorHandler()}
+
+	pb.RegisterDatastoreServer(d.server, d)
+
+	go d.server.Serve(split.grpc)
+	go d.httpServer.Serve(split.http)
+
+	return d, nil
+}
+
+// Addr returns the IP:PORT address the fake datastore is listening on. It's suitable for use
+// as the value of the DATASTORE_EMULATOR_HOST environment variable. Like the gcloud Datastore
+// emulator, the fake also serves HTTP on this address, so POST /reset deletes all its data.
+func (d *Datastore) Addr() string {
+	return d.listener.Addr().String()
+}
+
+// ProjectID returns the ID of the project served by the fake datastore.
+func (d *Datastore) ProjectID() string {
+	return d.projectID
+}
+
+// ClientOptions returns the options needed for a datastore client to connect to the fake
+// datastore without credentials.
+func (d *Datastore) ClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(d.Addr()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// Reset deletes all entities and abandons all open transactions.
+func (d *Datastore) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entities = make(map[string]*storedEntity)
+	d.updated = make(map[string]int64)
+	d.txns = make(map[string]*transaction)
+	d.version = 0
+	d.nextID = 1000
+}
+
+// Len returns the number of entities currently stored.
+func (d *Datastore) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.entities)
+}
+
+// Close stops the fake datastore.
+func (d *Datastore) Close() error {
+	d.server.Stop()
+	d.httpServer.Close()
+
+	return d.listener.Close()
+}
+
+// Lookup looks up entities by key.
+func (d *Datastore) Lookup(ctx context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	txnID, txn, err := d.readTransaction(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.LookupResponse{Transaction: txnID}
+
+	for _, key := range req.Keys {
+		if err := d.checkKey(key, true); err != nil {
+			return nil, err
+		}
+
+		ks := keyString(key)
+		if txn != nil {
+			txn.reads[ks] = true
+		}
+
+		stored, ok := d.entities[ks]
+		if !ok {
+			resp.Missing = append(resp.Missing, &pb.EntityResult{
+				Entity:  &pb.Entity{Key: key},
+				Version: d.version,
+			})
+			continue
+		}
+
+		resp.Found = append(resp.Found, &pb.EntityResult{
+			Entity:  proto.Clone(stored.entity).(*pb.Entity),
+			Version: stored.version,
+		})
+	}
+
+	return resp, nil
+}
+
+// BeginTransaction begins a new transaction.
+func (d *Datastore) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	readOnly := req.TransactionOptions != nil && req.TransactionOptions.GetReadOnly() != nil
+
+	return &pb.BeginTransactionResponse{Transaction: d.beginTransaction(readOnly)}, nil
+}
+
+// Rollback rolls back a transaction.
+func (d *Datastore) Rollback(ctx context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.txns[string(req.Transaction)]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid transaction: %q", req.Transaction)
+	}
+
+	delete(d.txns, string(req.Transaction))
+
+	return &pb.RollbackResponse{}, nil
+}
+
+// Commit applies a set of mutations atomically, optionally as the end of a transaction.
+func (d *Datastore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var txn *transaction
+
+	if req.Mode == pb.CommitRequest_TRANSACTIONAL {
+		id := string(req.GetTransaction())
+
+		var ok bool
+		txn, ok = d.txns[id]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid transaction: %q", id)
+		}
+
+		if txn.readOnly && len(req.Mutations) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "cannot modify entities in a read-only transaction")
+		}
+	}
+
+	// Validate all the mutations before applying any of them, so the commit is atomic.
+	type pendingWrite struct {
+		key       string
+		entity    *pb.Entity
+		allocated bool
+	}
+
+	writes := make([]pendingWrite, 0, len(req.Mutations))
+	seen := make(map[string]bool, len(req.Mutations))
+	nextID := d.nextID
+
+	for _, mut := range req.Mutations {
+		if len(mut.PropertyTransforms) > 0 {
+			return nil, status.Error(codes.Unimplemented, "property transforms are not supported")
+		}
+
+		var entity *pb.Entity
+		var key *pb.Key
+
+		switch op := mut.Operation.(type) {
+		case *pb.Mutation_Insert:
+			entity = op.Insert
+		case *pb.Mutation_Update:
+			entity = op.Update
+		case *pb.Mutation_Upsert:
+			entity = op.Upsert
+		case *pb.Mutation_Delete:
+			key = op.Delete
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unsupported mutation")
+		}
+
+		if entity != nil {
+			key = entity.Key
+		}
+
+		_, isInsert := mut.Operation.(*pb.Mutation_Insert)
+		_, isUpsert := mut.Operation.(*pb.Mutation_Upsert)
+
+		if err := d.checkKey(key, !isInsert && !isUpsert); err != nil {
+			return nil, err
+		}
+
+		allocated := false
+		if incomplete(key) {
+			key = proto.Clone(key).(*pb.Key)
+			key.Path[len(key.Path)-1].IdType = &pb.Key_PathElement_Id{Id: nextID}
+			nextID++
+			allocated = true
+		}
+
+		ks := keyString(key)
+
+		if seen[ks] {
+			return nil, status.Error(codes.InvalidArgument, "a single commit cannot write to the same entity more than once")
+		}
+		seen[ks] = true
+
+		_, exists := d.entities[ks]
+
+		switch mut.Operation.(type) {
+		case *pb.Mutation_Insert:
+			if exists {
+				return nil, status.Error(codes.AlreadyExists, "entity already exists")
+			}
+		case *pb.Mutation_Update:
+			if !exists {
+				return nil, status.Error(codes.NotFound, "no entity to update")
+			}
+		}
+
+		if entity != nil {
+			entity = proto.Clone(entity).(*pb.Entity)
+			entity.Key = key
+		}
+
+		writes = append(writes, pendingWrite{key: ks, entity: entity, allocated: allocated})
+	}
+
+	// Abort the transaction if anything it read or is writing changed after it started.
+	if txn != nil {
+		for ks := range txn.reads {
+			if d.updated[ks] > txn.start {
+				return nil, status.Error(codes.Aborted, "too much contention on these datastore entities")
+			}
+		}
+
+		for _, w := range writes {
+			if d.updated[w.key] > txn.start {
+				return nil, status.Error(codes.Aborted, "too much contention on these datastore entities")
+			}
+		}
+	}
+
+	// The transaction ends once it's committed. If the commit fails, it stays open so that it
+	// can be rolled back, the same way the datastore's client library does.
+	if txn != nil {
+		delete(d.txns, string(req.GetTransaction()))
+	}
+
+	// Apply the mutations.
+	d.nextID = nextID
+	d.version++
+
+	resp := &pb.CommitResponse{IndexUpdates: int32(len(writes))}
+
+	for _, w := range writes {
+		d.updated[w.key] = d.version
+
+		result := &pb.MutationResult{Version: d.version}
+
+		if w.entity == nil {
+			delete(d.entities, w.key)
+		} else {
+			d.entities[w.key] = &storedEntity{entity: w.entity, version: d.version}
+
+			if w.allocated {
+				result.Key = proto.Clone(w.entity.Key).(*pb.Key)
+			}
+		}
+
+		resp.MutationResults = append(resp.MutationResults, result)
+	}
+
+	return resp, nil
+}
+
+// AllocateIds allocates IDs for incomplete keys.
+func (d *Datastore) AllocateIds(ctx context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	resp := &pb.AllocateIdsResponse{}
+
+	for _, key := range req.Keys {
+		if err := d.checkKey(key, false); err != nil {
+			return nil, err
+		}
+		if !incomplete(key) {
+			return nil, status.Error(codes.InvalidArgument, "cannot allocate an ID for a complete key")
+		}
+
+		key = proto.Clone(key).(*pb.Key)
+		key.Path[len(key.Path)-1].IdType = &pb.Key_PathElement_Id{Id: d.nextID}
+		d.nextID++
+
+		resp.Keys = append(resp.Keys, key)
+	}
+
+	return resp, nil
+}
+
+// ReserveIds prevents IDs from being allocated.
+func (d *Datastore) ReserveIds(ctx context.Context, req *pb.ReserveIdsRequest) (*pb.ReserveIdsResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range req.Keys {
+		if err := d.checkKey(key, true); err != nil {
+			return nil, err
+		}
+
+		if id := key.Path[len(key.Path)-1].GetId(); id >= d.nextID {
+			d.nextID = id + 1
+		}
+	}
+
+	return &pb.ReserveIdsResponse{}, nil
+}
+
+// RunQuery runs a query. All results are returned in a single batch.
+func (d *Datastore) RunQuery(ctx context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	if err := d.checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+
+	q := req.GetQuery()
+	if q == nil {
+		return nil, status.Error(codes.Unimplemented, "GQL queries are not supported")
+	}
+	if len(q.Kind) > 1 {
+		return nil, status.Error(codes.InvalidArgument, "queries can only have one kind")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	txnID, txn, err := d.readTransaction(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := req.GetPartitionId().GetNamespaceId()
+
+	// Collect the matching entities.
+	matches := make([]*storedEntity, 0)
+
+	for ks, stored := range d.entities {
+		key := stored.entity.Key
+		if key.GetPartitionId().GetNamespaceId() != namespace {
+			continue
+		}
+		if len(q.Kind) == 1 && key.Path[len(key.Path)-1].Kind != q.Kind[0].Name {
+			continue
+		}
+
+		ok, err := matchFilter(stored.entity, q.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if !hasOrderProperties(stored.entity, q.Order) {
+			continue
+		}
+
+		if txn != nil {
+			txn.reads[ks] = true
+		}
+
+		matches = append(matches, stored)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return compareEntities(matches[i].entity, matches[j].entity, q.Order) < 0
+	})
+
+	// Apply the start and end cursors, then the offset and limit.
+	start, err := decodeCursor(q.StartCursor)
+	if err != nil {
+		return nil, err
+	}
+	end := len(matches)
+	if len(q.EndCursor) > 0 {
+		end, err = decodeCursor(q.EndCursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if end > len(matches) {
+		end = len(matches)
+	}
+	if start > end {
+		start = end
+	}
+
+	skipped := int(q.Offset)
+	if skipped > end-start {
+		skipped = end - start
+	}
+	pos := start + skipped
+
+	stop := end
+	moreResults := pb.QueryResultBatch_NO_MORE_RESULTS
+	if q.Limit != nil && pos+int(q.Limit.Value) < end {
+		stop = pos + int(q.Limit.Value)
+		moreResults = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	}
+
+	resultType, project := projection(q.Projection)
+
+	batch := &pb.QueryResultBatch{
+		SkippedResults:   int32(skipped),
+		EntityResultType: resultType,
+		EndCursor:        encodeCursor(stop),
+		MoreResults:      moreResults,
+		SnapshotVersion:  d.version,
+	}
+	if skipped > 0 {
+		batch.SkippedCursor = encodeCursor(pos)
+	}
+
+	for i := pos; i < stop; i++ {
+		batch.EntityResults = append(batch.EntityResults, &pb.EntityResult{
+			Entity:  project(matches[i].entity),
+			Version: matches[i].version,
+			Cursor:  encodeCursor(i + 1),
+		})
+	}
+
+	return &pb.RunQueryResponse{Batch: batch, Query: q, Transaction: txnID}, nil
+}
+
+// checkProject makes sure a request is for the project served by the fake datastore.
+func (d *Datastore) checkProject(projectID string) error {
+	if projectID != d.projectID {
+		return status.Errorf(codes.NotFound, "The project %s does not exist or it does not contain an active Cloud Datastore or Cloud Firestore database.", projectID)
+	}
+
+	return nil
+}
+
+// checkKey validates a key, optionally requiring it to be complete.
+func (d *Datastore) checkKey(key *pb.Key, complete bool) error {
+	if key == nil || len(key.Path) == 0 {
+		return status.Error(codes.InvalidArgument, "a key must have a non-empty path")
+	}
+
+	if projectID := key.GetPartitionId().GetProjectId(); projectID != "" && projectID != d.projectID {
+		return status.Errorf(codes.InvalidArgument, "mismatched project ID in key: %s", projectID)
+	}
+
+	for i, elem := range key.Path {
+		if elem.Kind == "" {
+			return status.Error(codes.InvalidArgument, "a key path element must have a kind")
+		}
+		if elem.IdType == nil && (complete || i < len(key.Path)-1) {
+			return status.Error(codes.InvalidArgument, "a key path element must be complete")
+		}
+	}
+
+	return nil
+}
+
+// beginTransaction starts a transaction and returns its ID. The caller must hold d.mu.
+func (d *Datastore) beginTransaction(readOnly bool) []byte {
+	d.nextTxn++
+	id := strconv.FormatInt(d.nextTxn, 10)
+
+	d.txns[id] = &transaction{
+		readOnly: readOnly,
+		start:    d.version,
+		reads:    make(map[string]bool),
+	}
+
+	return []byte(id)
+}
+
+// readTransaction returns the transaction that a read should take part in, if any, starting a
+// new one if the read options ask for it. The caller must hold d.mu.
+func (d *Datastore) readTransaction(opts *pb.ReadOptions) ([]byte, *transaction, error) {
+	if opts == nil {
+		return nil, nil, nil
+	}
+
+	if newTxn := opts.GetNewTransaction(); newTxn != nil {
+		id := d.beginTransaction(newTxn.GetReadOnly() != nil)
+		return id, d.txns[string(id)], nil
+	}
+
+	if id := opts.GetTransaction(); id != nil {
+		txn, ok := d.txns[string(id)]
+		if !ok {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid transaction: %q", id)
+		}
+		return nil, txn, nil
+	}
+
+	return nil, nil, nil
+}
+
+// incomplete reports whether the last element of a key's path is missing its ID or name.
+func incomplete(key *pb.Key) bool {
+	return key.Path[len(key.Path)-1].IdType == nil
+}
+
+// keyString returns a string which uniquely identifies a complete key.
+func keyString(key *pb.Key) string {
+	var b strings.Builder
+
+	b.WriteString(strconv.Quote(key.GetPartitionId().GetNamespaceId()))
+
+	for _, elem := range key.Path {
+		b.WriteString("/")
+		b.WriteString(strconv.Quote(elem.Kind))
+		b.WriteString(",")
+
+		if name, ok := elem.IdType.(*pb.Key_PathElement_Name); ok {
+			b.WriteString(strconv.Quote(name.Name))
+		} else {
+			b.WriteString(strconv.FormatInt(elem.GetId(), 10))
+		}
+	}
+
+	return b.String()
+}
+
+// encodeCursor encodes a position in a query's results as a cursor.
+func encodeCursor(pos int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(pos))
+}
+
+// decodeCursor decodes a cursor made by encodeCursor. An empty cursor is the start of the results.
+func decodeCursor(cursor []byte) (int, error) {
+	if len(cursor) == 0 {
+		return 0, nil
+	}
+	if len(cursor) != 8 {
+		return 0, status.Error(codes.InvalidArgument, "invalid query cursor")
+	}
+
+	return int(binary.BigEndian.Uint64(cursor)), nil
+}
+
+// projection returns the result type of a query with the given projection, and a function
+// which applies the projection to an entity.
+func projection(props []*pb.Projection) (pb.EntityResult_ResultType, func(*pb.Entity) *pb.Entity) {
+	if len(props) == 0 {
+		return pb.EntityResult_FULL, func(e *pb.Entity) *pb.Entity {
+			return proto.Clone(e).(*pb.Entity)
+		}
+	}
+
+	if len(props) == 1 && props[0].Property.Name == "__key__" {
+		return pb.EntityResult_KEY_ONLY, func(e *pb.Entity) *pb.Entity {
+			return &pb.Entity{Key: proto.Clone(e.Key).(*pb.Key)}
+		}
+	}
+
+	return pb.EntityResult_PROJECTION, func(e *pb.Entity) *pb.Entity {
+		res := &pb.Entity{
+			Key:        proto.Clone(e.Key).(*pb.Key),
+			Properties: make(map[string]*pb.Value, len(props)),
+		}
+		for _, p := range props {
+			if v, ok := e.Properties[p.Property.Name]; ok {
+				res.Properties[p.Property.Name] = proto.Clone(v).(*pb.Value)
+			}
+		}
+		return res
+	}
+}
+
+// property returns the value of an entity's property, including the special __key__ property.
+func property(e *pb.Entity, name string) (*pb.Value, bool) {
+	if name == "__key__" {
+		return &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: e.Key}}, true
+	}
+
+	v, ok := e.Properties[name]
+	return v, ok
+}
+
+// hasOrderProperties reports whether an entity has all the properties a query is ordered by.
+// Entities without them are excluded from the results, like in the real datastore.
+func hasOrderProperties(e *pb.Entity, orders []*pb.PropertyOrder) bool {
+	for _, o := range orders {
+		if _, ok := property(e, o.Property.Name); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareEntities orders two entities by the query's sort orders, and then by key.
+func compareEntities(a, b *pb.Entity, orders []*pb.PropertyOrder) int {
+	for _, o := range orders {
+		av, _ := property(a, o.Property.Name)
+		bv, _ := property(b, o.Property.Name)
+
+		c := compareValues(av, bv)
+		if o.Direction == pb.PropertyOrder_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	return compareKeys(a.Key, b.Key)
+}
+
+// matchFilter reports whether an entity matches a query filter.
+func matchFilter(e *pb.Entity, f *pb.Filter) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+
+	if cf := f.GetCompositeFilter(); cf != nil {
+		for _, sub := range cf.Filters {
+			ok, err := matchFilter(e, sub)
+			if err != nil {
+				return false, err
+			}
+			if cf.Op == pb.CompositeFilter_OR && ok {
+				return true, nil
+			}
+			if cf.Op != pb.CompositeFilter_OR && !ok {
+				return false, nil
+			}
+		}
+		return cf.Op != pb.CompositeFilter_OR, nil
+	}
+
+	pf := f.GetPropertyFilter()
+	if pf == nil {
+		return false, status.Error(codes.InvalidArgument, "unsupported filter")
+	}
+
+	if pf.Op == pb.PropertyFilter_HAS_ANCESTOR {
+		ancestor := pf.Value.GetKeyValue()
+		if ancestor == nil {
+			return false, status.Error(codes.InvalidArgument, "ancestor filter requires a key value")
+		}
+		return hasAncestor(e.Key, ancestor), nil
+	}
+
+	v, ok := property(e, pf.Property.Name)
+	if !ok {
+		return false, nil
+	}
+
+	// Array properties match if any of their elements match.
+	values := []*pb.Value{v}
+	if arr := v.GetArrayValue(); arr != nil {
+		values = arr.Values
+	}
+
+	for _, v := range values {
+		if matchValue(v, pf.Op, pf.Value) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchValue reports whether a single property value satisfies a filter operator.
+func matchValue(v *pb.Value, op pb.PropertyFilter_Operator, operand *pb.Value) bool {
+	switch op {
+	case pb.PropertyFilter_EQUAL:
+		return compareValues(v, operand) == 0
+	case pb.PropertyFilter_NOT_EQUAL:
+		return compareValues(v, operand) != 0
+	case pb.PropertyFilter_LESS_THAN:
+		return sameOrderClass(v, operand) && compareValues(v, operand) < 0
+	case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+		return sameOrderClass(v, operand) && compareValues(v, operand) <= 0
+	case pb.PropertyFilter_GREATER_THAN:
+		return sameOrderClass(v, operand) && compareValues(v, operand) > 0
+	case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+		return sameOrderClass(v, operand) && compareValues(v, operand) >= 0
+	case pb.PropertyFilter_IN:
+		for _, o := range operand.GetArrayValue().GetValues() {
+			if compareValues(v, o) == 0 {
+				return true
+			}
+		}
+		return false
+	case pb.PropertyFilter_NOT_IN:
+		for _, o := range operand.GetArrayValue().GetValues() {
+			if compareValues(v, o) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// hasAncestor reports whether ancestor is a prefix of key's path, or the key itself.
+func hasAncestor(key, ancestor *pb.Key) bool {
+	if key.GetPartitionId().GetNamespaceId() != ancestor.GetPartitionId().GetNamespaceId() {
+		return false
+	}
+	if len(ancestor.Path) > len(key.Path) {
+		return false
+	}
+
+	prefix := &pb.Key{PartitionId: key.PartitionId, Path: key.Path[:len(ancestor.Path)]}
+	return compareKeys(prefix, ancestor) == 0
+}
+
+// valueRank returns the position of a value's type in the datastore's sort order.
+func valueRank(v *pb.Value) int {
+	switch v.GetValueType().(type) {
+	case nil, *pb.Value_NullValue:
+		return 0
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return 1
+	case *pb.Value_TimestampValue:
+		return 2
+	case *pb.Value_BooleanValue:
+		return 3
+	case *pb.Value_BlobValue:
+		return 4
+	case *pb.Value_StringValue:
+		return 5
+	case *pb.Value_GeoPointValue:
+		return 6
+	case *pb.Value_KeyValue:
+		return 7
+	case *pb.Value_EntityValue:
+		return 8
+	case *pb.Value_ArrayValue:
+		return 9
+	}
+
+	return 10
+}
+
+// sameOrderClass reports whether two values can be compared by an inequality filter.
+func sameOrderClass(a, b *pb.Value) bool {
+	return valueRank(a) == valueRank(b)
+}
+
+// compareValues orders two values the way the datastore does.
+func compareValues(a, b *pb.Value) int {
+	if ra, rb := valueRank(a), valueRank(b); ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+
+	switch av := a.GetValueType().(type) {
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return compareNumbers(a, b)
+	case *pb.Value_TimestampValue:
+		at, bt := av.TimestampValue.AsTime(), b.GetTimestampValue().AsTime()
+		switch {
+		case at.Before(bt):
+			return -1
+		case at.After(bt):
+			return 1
+		}
+		return 0
+	case *pb.Value_BooleanValue:
+		ab, bb := av.BooleanValue, b.GetBooleanValue()
+		switch {
+		case ab == bb:
+			return 0
+		case !ab:
+			return -1
+		}
+		return 1
+	case *pb.Value_BlobValue:
+		return bytes.Compare(av.BlobValue, b.GetBlobValue())
+	case *pb.Value_StringValue:
+		return strings.Compare(av.StringValue, b.GetStringValue())
+	case *pb.Value_GeoPointValue:
+		ag, bg := av.GeoPointValue, b.GetGeoPointValue()
+		if c := compareFloats(ag.GetLatitude(), bg.GetLatitude()); c != 0 {
+			return c
+		}
+		return compareFloats(ag.GetLongitude(), bg.GetLongitude())
+	case *pb.Value_KeyValue:
+		return compareKeys(av.KeyValue, b.GetKeyValue())
+	case *pb.Value_EntityValue, *pb.Value_ArrayValue:
+		if proto.Equal(a, b) {
+			return 0
+		}
+		return strings.Compare(a.String(), b.String())
+	}
+
+	return 0
+}
+
+// compareNumbers compares two integer or double values.
+func compareNumbers(a, b *pb.Value) int {
+	ai, aIsInt := a.GetValueType().(*pb.Value_IntegerValue)
+	bi, bIsInt := b.GetValueType().(*pb.Value_IntegerValue)
+	if aIsInt && bIsInt {
+		return compareInts(ai.IntegerValue, bi.IntegerValue)
+	}
+
+	af, bf := a.GetDoubleValue(), b.GetDoubleValue()
+	if aIsInt {
+		af = float64(ai.IntegerValue)
+	}
+	if bIsInt {
+		bf = float64(bi.IntegerValue)
+	}
+
+	return compareFloats(af, bf)
+}
+
+// compareKeys orders two keys by namespace and then path, with IDs before names.
+func compareKeys(a, b *pb.Key) int {
+	if c := strings.Compare(a.GetPartitionId().GetNamespaceId(), b.GetPartitionId().GetNamespaceId()); c != 0 {
+		return c
+	}
+
+	for i := 0; i < len(a.Path) && i < len(b.Path); i++ {
+		ae, be := a.Path[i], b.Path[i]
+
+		if c := strings.Compare(ae.Kind, be.Kind); c != 0 {
+			return c
+		}
+
+		an, aIsName := ae.IdType.(*pb.Key_PathElement_Name)
+		bn, bIsName := be.IdType.(*pb.Key_PathElement_Name)
+
+		switch {
+		case aIsName && bIsName:
+			if c := strings.Compare(an.Name, bn.Name); c != 0 {
+				return c
+			}
+		case aIsName:
+			return 1
+		case bIsName:
+			return -1
+		default:
+			if c := compareInts(ae.GetId(), be.GetId()); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return compareInts(int64(len(a.Path)), int64(len(b.Path)))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
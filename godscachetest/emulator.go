@@ -0,0 +1,153 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscachetest
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// http2Preface is how every HTTP/2 connection, and so every gRPC connection, begins.
+var http2Preface = []byte("PRI * HTTP/2.0")
+
+// emulatorHandler serves the HTTP endpoints of the gcloud Datastore emulator which tests use to
+// manage it. POST /reset deletes all data, and GET / is a health check.
+func (d *Datastore) emulatorHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		d.Reset()
+		w.Write([]byte("Resetting...\n"))
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte("Ok\n"))
+	})
+
+	return mux
+}
+
+// splitListener accepts connections from a listener, and hands each one to the gRPC listener
+// or the HTTP/1 listener depending on how it begins. This lets gRPC requests and the emulator's
+// HTTP endpoints share a port, like they do in the gcloud Datastore emulator.
+type splitListener struct {
+	net.Listener
+
+	grpc *connListener
+	http *connListener
+}
+
+// newSplitListener starts splitting the connections accepted by lis.
+func newSplitListener(lis net.Listener) *splitListener {
+	s := &splitListener{
+		Listener: lis,
+		grpc:     newConnListener(lis.Addr()),
+		http:     newConnListener(lis.Addr()),
+	}
+
+	go s.serve()
+
+	return s
+}
+
+// serve accepts connections until the listener is closed.
+func (s *splitListener) serve() {
+	defer s.grpc.Close()
+	defer s.http.Close()
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.route(conn)
+	}
+}
+
+// route peeks at the start of a connection to decide where to send it.
+func (s *splitListener) route(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	start, err := r.Peek(len(http2Preface))
+	if err != nil && len(start) == 0 {
+		conn.Close()
+		return
+	}
+
+	peeked := &peekedConn{Conn: conn, r: r}
+
+	if bytes.HasPrefix(start, http2Preface) {
+		s.grpc.push(peeked)
+	} else {
+		s.http.push(peeked)
+	}
+}
+
+// peekedConn is a connection whose first bytes have been buffered by a bufio.Reader.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener is a net.Listener which accepts connections pushed to it.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push hands a connection to whoever is accepting from the listener.
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
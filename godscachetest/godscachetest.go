@@ -0,0 +1,17 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+// Package godscachetest provides in-process fakes of the services godscache depends on, so that
+// code using godscache can be tested without a Google Cloud project or a memcached server.
+//
+// Datastore is an in-memory implementation of the Cloud Datastore gRPC API. The official
+// "cloud.google.com/go/datastore" client talks to it exactly like it talks to the real service,
+// either by pointing the DATASTORE_EMULATOR_HOST environment variable at its address, or by
+// passing the result of its ClientOptions method to datastore.NewClient or godscache.NewClient.
+//
+// Memcached is an in-memory server speaking the memcached text protocol, which can be used with
+// the GODSCACHE_MEMCACHED_SERVERS environment variable or the godscache.MemcacheServerKey
+// context value.
+//
+// Both servers listen on a random loopback port, and neither of them needs network access.
+package godscachetest
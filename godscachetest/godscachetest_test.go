@@ -0,0 +1,191 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscachetest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+	"google.golang.org/api/iterator"
+)
+
+type testEntity struct {
+	Name  string
+	Count int
+}
+
+func TestDatastoreClientOptions(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := NewDatastore("godscachetest")
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: failed starting fake datastore: %v", err)
+	}
+	defer ds.Close()
+
+	c, err := datastore.NewClient(ctx, ds.ProjectID(), ds.ClientOptions()...)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: failed creating datastore client: %v", err)
+	}
+	defer c.Close()
+
+	keys := []*datastore.Key{
+		datastore.IncompleteKey("testEntity", nil),
+		datastore.NameKey("testEntity", "b", nil),
+		datastore.IncompleteKey("testEntity", nil),
+	}
+	src := []*testEntity{{Name: "a", Count: 3}, {Name: "b", Count: 1}, {Name: "c", Count: 2}}
+
+	keys, err = c.PutMulti(ctx, keys, src)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: failed putting entities: %v", err)
+	}
+	if keys[0].Incomplete() || keys[2].Incomplete() || keys[0].ID == keys[2].ID {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: expected unique allocated keys, got %v", keys)
+	}
+
+	var dst testEntity
+	err = c.Get(ctx, keys[1], &dst)
+	if err != nil || dst != *src[1] {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: got %+v, %v; want %+v", dst, err, *src[1])
+	}
+
+	q := datastore.NewQuery("testEntity").Filter("Count >=", 2).Order("-Count")
+	var names []string
+	for it := c.Run(ctx, q); ; {
+		var res testEntity
+		_, err := it.Next(&res)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("godscachetest.TestDatastoreClientOptions: failed running query: %v", err)
+		}
+		names = append(names, res.Name)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: query returned %v, want [a c]", names)
+	}
+
+	err = c.DeleteMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: failed deleting entities: %v", err)
+	}
+
+	if n := ds.Len(); n != 0 {
+		t.Fatalf("godscachetest.TestDatastoreClientOptions: %v entities left after deleting them all", n)
+	}
+}
+
+func TestDatastoreTransactionConflict(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := NewDatastore("godscachetest")
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed starting fake datastore: %v", err)
+	}
+	defer ds.Close()
+
+	c, err := datastore.NewClient(ctx, ds.ProjectID(), ds.ClientOptions()...)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed creating datastore client: %v", err)
+	}
+	defer c.Close()
+
+	key := datastore.NameKey("testEntity", "counter", nil)
+	_, err = c.Put(ctx, key, &testEntity{Count: 1})
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed putting entity: %v", err)
+	}
+
+	tx, err := c.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed starting transaction: %v", err)
+	}
+
+	var dst testEntity
+	err = tx.Get(key, &dst)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed getting entity in transaction: %v", err)
+	}
+
+	// Write the entity outside the transaction, so that committing the transaction conflicts.
+	_, err = c.Put(ctx, key, &testEntity{Count: 5})
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed putting entity: %v", err)
+	}
+
+	dst.Count++
+	_, err = tx.Put(key, &dst)
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: failed putting entity in transaction: %v", err)
+	}
+
+	_, err = tx.Commit()
+	if err != datastore.ErrConcurrentTransaction {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: commit returned %v, want %v", err, datastore.ErrConcurrentTransaction)
+	}
+
+	// The aborted transaction can be rolled back, so RunInTransaction can retry it.
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatalf("godscachetest.TestDatastoreTransactionConflict: rollback after an aborted commit returned %v", err)
+	}
+}
+
+func TestMemcached(t *testing.T) {
+	mc, err := NewMemcached()
+	if err != nil {
+		t.Fatalf("godscachetest.TestMemcached: failed starting fake memcached: %v", err)
+	}
+	defer mc.Close()
+
+	c := memcache.New(mc.Addr())
+
+	err = c.Set(&memcache.Item{Key: "a", Value: []byte("1")})
+	if err != nil {
+		t.Fatalf("godscachetest.TestMemcached: failed setting item: %v", err)
+	}
+
+	err = c.Add(&memcache.Item{Key: "a", Value: []byte("2")})
+	if err != memcache.ErrNotStored {
+		t.Fatalf("godscachetest.TestMemcached: adding an existing item returned %v, want %v", err, memcache.ErrNotStored)
+	}
+
+	n, err := c.Increment("a", 41)
+	if err != nil || n != 42 {
+		t.Fatalf("godscachetest.TestMemcached: increment returned %v, %v; want 42", n, err)
+	}
+
+	items, err := c.GetMulti([]string{"a", "missing"})
+	if err != nil || len(items) != 1 || !bytes.Equal(items["a"].Value, []byte("42")) {
+		t.Fatalf("godscachetest.TestMemcached: get multi returned %v, %v", items, err)
+	}
+
+	mc.SetMaxItemSize(4)
+	err = c.Set(&memcache.Item{Key: "big", Value: []byte("too large")})
+	if err == nil {
+		t.Fatalf("godscachetest.TestMemcached: succeeded setting an item larger than the max item size")
+	}
+
+	err = c.Set(&memcache.Item{Key: "expired", Value: []byte("x"), Expiration: -1})
+	if err != nil {
+		t.Fatalf("godscachetest.TestMemcached: failed setting item: %v", err)
+	}
+	_, err = c.Get("expired")
+	if err != memcache.ErrCacheMiss {
+		t.Fatalf("godscachetest.TestMemcached: getting an expired item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+
+	err = c.DeleteAll()
+	if err != nil {
+		t.Fatalf("godscachetest.TestMemcached: failed flushing all items: %v", err)
+	}
+	if n := mc.Len(); n != 0 {
+		t.Fatalf("godscachetest.TestMemcached: %v items left after flushing them all", n)
+	}
+}
@@ -0,0 +1,452 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscachetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxItemSize is the largest value the fake memcached server accepts by default. It's
+// the same as memcached's default item size limit.
+const DefaultMaxItemSize = 1024 * 1024
+
+// Memcached is an in-memory fake memcached server. It speaks the memcached text protocol on a
+// loopback port, and supports the storage, retrieval, deletion, increment/decrement, touch and
+// flush_all commands.
+type Memcached struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	items       map[string]*memcachedItem
+	cas         uint64
+	maxItemSize int
+	conns       map[net.Conn]bool
+	closed      bool
+
+	wg sync.WaitGroup
+}
+
+// memcachedItem is a value stored in the fake memcached server.
+type memcachedItem struct {
+	value   []byte
+	flags   uint32
+	expires time.Time
+	cas     uint64
+}
+
+// NewMemcached starts a fake memcached server on a random loopback port.
+func NewMemcached() (*Memcached, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("godscachetest.NewMemcached: failed listening on loopback: %v", err)
+	}
+
+	m := &Memcached{
+		listener:    lis,
+		items:       make(map[string]*memcachedItem),
+		maxItemSize: DefaultMaxItemSize,
+		conns:       make(map[net.Conn]bool),
+	}
+
+	m.wg.Add(1)
+	go m.serve()
+
+	return m, nil
+}
+
+// Addr returns the IP:PORT address the fake memcached server is listening on.
+func (m *Memcached) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// SetMaxItemSize changes the largest value the server accepts, in bytes.
+func (m *Memcached) SetMaxItemSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxItemSize = size
+}
+
+// Reset deletes all items.
+func (m *Memcached) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items = make(map[string]*memcachedItem)
+}
+
+// Len returns the number of unexpired items currently stored.
+func (m *Memcached) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key := range m.items {
+		if m.lookup(key) != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Keys returns the keys of all unexpired items currently stored, in no particular order.
+func (m *Memcached) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.items))
+	for key := range m.items {
+		if m.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Close stops the server and closes all client connections.
+func (m *Memcached) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	for conn := range m.conns {
+		conn.Close()
+	}
+	m.mu.Unlock()
+
+	err := m.listener.Close()
+	m.wg.Wait()
+
+	return err
+}
+
+// serve accepts client connections until the server is closed.
+func (m *Memcached) serve() {
+	defer m.wg.Done()
+
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.conns[conn] = true
+		m.mu.Unlock()
+
+		m.wg.Add(1)
+		go m.handle(conn)
+	}
+}
+
+// handle serves the commands sent on a single client connection.
+func (m *Memcached) handle(conn net.Conn) {
+	defer m.wg.Done()
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			rw.WriteString("ERROR\r\n")
+			rw.Flush()
+			continue
+		}
+
+		if fields[0] == "quit" {
+			return
+		}
+
+		if err := m.command(rw, fields); err != nil {
+			return
+		}
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// command runs a single command. It returns an error only if the connection should be closed.
+func (m *Memcached) command(rw *bufio.ReadWriter, fields []string) error {
+	cmd, args := fields[0], fields[1:]
+
+	// Strip the noreply flag, remembering whether a response is wanted.
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+
+	reply := func(s string) {
+		if !noreply {
+			rw.WriteString(s)
+		}
+	}
+
+	switch cmd {
+	case "get", "gets":
+		m.mu.Lock()
+		for _, key := range args {
+			item := m.lookup(key)
+			if item == nil {
+				continue
+			}
+			if cmd == "gets" {
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.value), item.cas)
+			} else {
+				fmt.Fprintf(rw, "VALUE %s %d %d\r\n", key, item.flags, len(item.value))
+			}
+			rw.Write(item.value)
+			rw.WriteString("\r\n")
+		}
+		m.mu.Unlock()
+		rw.WriteString("END\r\n")
+
+	case "set", "add", "replace", "append", "prepend", "cas":
+		want := 4
+		if cmd == "cas" {
+			want = 5
+		}
+		if len(args) != want {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+
+		flags, err1 := strconv.ParseUint(args[1], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+		size, err3 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+			rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+
+		var casID uint64
+		if cmd == "cas" {
+			var err error
+			casID, err = strconv.ParseUint(args[4], 10, 64)
+			if err != nil {
+				rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+				return nil
+			}
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return err
+		}
+		if string(data[size:]) != "\r\n" {
+			rw.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+
+		reply(m.store(cmd, args[0], uint32(flags), exptime, data[:size], casID))
+
+	case "delete":
+		if len(args) != 1 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+
+		m.mu.Lock()
+		if m.lookup(args[0]) == nil {
+			reply("NOT_FOUND\r\n")
+		} else {
+			delete(m.items, args[0])
+			reply("DELETED\r\n")
+		}
+		m.mu.Unlock()
+
+	case "incr", "decr":
+		if len(args) != 2 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return nil
+		}
+
+		m.mu.Lock()
+		reply(m.incrDecr(cmd, args[0], delta))
+		m.mu.Unlock()
+
+	case "touch":
+		if len(args) != 2 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+
+		m.mu.Lock()
+		if item := m.lookup(args[0]); item != nil {
+			item.expires = expiry(exptime)
+			reply("TOUCHED\r\n")
+		} else {
+			reply("NOT_FOUND\r\n")
+		}
+		m.mu.Unlock()
+
+	case "flush_all":
+		m.Reset()
+		reply("OK\r\n")
+
+	case "version":
+		rw.WriteString("VERSION godscachetest\r\n")
+
+	default:
+		rw.WriteString("ERROR\r\n")
+	}
+
+	return nil
+}
+
+// store runs one of the storage commands, and returns the response line.
+func (m *Memcached) store(cmd, key string, flags uint32, exptime int64, value []byte, casID uint64) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(key) > 250 {
+		return "CLIENT_ERROR key too long\r\n"
+	}
+
+	existing := m.lookup(key)
+
+	switch cmd {
+	case "add":
+		if existing != nil {
+			return "NOT_STORED\r\n"
+		}
+	case "replace", "append", "prepend":
+		if existing == nil {
+			return "NOT_STORED\r\n"
+		}
+	case "cas":
+		if existing == nil {
+			return "NOT_FOUND\r\n"
+		}
+		if existing.cas != casID {
+			return "EXISTS\r\n"
+		}
+	}
+
+	// Append and prepend keep the existing flags and expiry time.
+	if cmd == "append" || cmd == "prepend" {
+		if cmd == "append" {
+			value = append(append([]byte{}, existing.value...), value...)
+		} else {
+			value = append(append([]byte{}, value...), existing.value...)
+		}
+		flags = existing.flags
+	}
+
+	if len(value) > m.maxItemSize {
+		return "SERVER_ERROR object too large for cache\r\n"
+	}
+
+	m.cas++
+	item := &memcachedItem{
+		value: append([]byte{}, value...),
+		flags: flags,
+		cas:   m.cas,
+	}
+
+	if cmd == "append" || cmd == "prepend" {
+		item.expires = existing.expires
+	} else {
+		item.expires = expiry(exptime)
+	}
+
+	m.items[key] = item
+
+	return "STORED\r\n"
+}
+
+// incrDecr runs the incr or decr command, and returns the response line. The caller must
+// hold m.mu.
+func (m *Memcached) incrDecr(cmd, key string, delta uint64) string {
+	item := m.lookup(key)
+	if item == nil {
+		return "NOT_FOUND\r\n"
+	}
+
+	val, err := strconv.ParseUint(string(item.value), 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"
+	}
+
+	if cmd == "incr" {
+		val += delta
+	} else if delta > val {
+		val = 0
+	} else {
+		val -= delta
+	}
+
+	m.cas++
+	item.value = []byte(strconv.FormatUint(val, 10))
+	item.cas = m.cas
+
+	return string(item.value) + "\r\n"
+}
+
+// lookup returns an unexpired item, deleting it if it has expired. The caller must hold m.mu.
+func (m *Memcached) lookup(key string) *memcachedItem {
+	item, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+
+	if !item.expires.IsZero() && !time.Now().Before(item.expires) {
+		delete(m.items, key)
+		return nil
+	}
+
+	return item
+}
+
+// expiry converts a memcached expiration time to an absolute time. Zero means the item never
+// expires, values up to 30 days are relative to now, larger values are unix timestamps, and
+// negative values expire the item immediately.
+func expiry(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime <= 60*60*24*30:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+
+	return time.Unix(exptime, 0)
+}
@@ -0,0 +1,440 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Invalidation says that the entities for some keys were written or deleted.
+type Invalidation struct {
+	// Source identifies the Client which published the invalidation, so it can ignore its own.
+	Source string
+
+	// The keys of the entities which were written or deleted.
+	Keys []*datastore.Key
+}
+
+// Invalidator carries invalidations between Clients, which can be in different processes, so
+// that each Client can forget the entities the others write or delete from its local cache.
+// Clients publish an invalidation for every Put, PutMulti, Delete and DeleteMulti. Set one with
+// Client.SetInvalidator.
+type Invalidator interface {
+	// Publish sends an invalidation to every subscriber, including the ones in this process.
+	Publish(ctx context.Context, inv Invalidation) error
+
+	// Subscribe calls f with every invalidation published from now on, until the returned
+	// function is called. f can be called from more than one goroutine at once.
+	Subscribe(f func(inv Invalidation)) (unsubscribe func(), err error)
+}
+
+// SetInvalidator makes the client publish invalidations to inv, and forget what other Clients
+// invalidate from its local cache. It replaces the client's previous Invalidator, if it had one.
+// Set it to nil to stop using one. Close stops the client using it, but doesn't close it, so it
+// can be shared by many Clients.
+func (c *Client) SetInvalidator(inv Invalidator) error {
+	c.invalidatorMu.Lock()
+	defer c.invalidatorMu.Unlock()
+
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+		c.unsubscribe = nil
+	}
+	c.invalidator = nil
+
+	if inv == nil {
+		return nil
+	}
+
+	unsubscribe, err := inv.Subscribe(c.handleInvalidation)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.SetInvalidator: failed subscribing to invalidations: %v", err)
+	}
+
+	c.invalidator = inv
+	c.unsubscribe = unsubscribe
+
+	return nil
+}
+
+// publishInvalidation tells the other Clients using the client's Invalidator that the entities
+// for keys were written or deleted. The write has already succeeded, so failures are only
+// logged, and the other Clients' local caches catch up after LocalCacheTTL.
+func (c *Client) publishInvalidation(ctx context.Context, keys []*datastore.Key) {
+	c.invalidatorMu.Lock()
+	inv := c.invalidator
+	c.invalidatorMu.Unlock()
+
+	if inv == nil || len(keys) == 0 {
+		return
+	}
+
+	err := inv.Publish(ctx, Invalidation{Source: c.id, Keys: keys})
+	if err != nil {
+		log.Printf("godscache.Client.publishInvalidation: failed publishing invalidation: %v", err)
+	}
+}
+
+// handleInvalidation forgets the entities another Client invalidated from the local cache.
+func (c *Client) handleInvalidation(inv Invalidation) {
+	if inv.Source == c.id {
+		return
+	}
+
+	for _, key := range inv.Keys {
+		if key != nil {
+			c.local.forget(cacheKey(key))
+		}
+	}
+}
+
+// randomID returns a random ID, such as the one a Client publishes invalidations with.
+func randomID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// subscribers holds the functions subscribed to an Invalidator. Its zero value is ready to use.
+type subscribers struct {
+	mu   sync.RWMutex
+	next int
+	fs   map[int]func(inv Invalidation)
+}
+
+// add subscribes f, and returns the function which unsubscribes it.
+func (s *subscribers) add(f func(inv Invalidation)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fs == nil {
+		s.fs = make(map[int]func(inv Invalidation))
+	}
+
+	id := s.next
+	s.next++
+	s.fs[id] = f
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.fs, id)
+	}
+}
+
+// deliver calls every subscribed function with inv.
+func (s *subscribers) deliver(inv Invalidation) {
+	s.mu.RLock()
+	fs := make([]func(inv Invalidation), 0, len(s.fs))
+	for _, f := range s.fs {
+		fs = append(fs, f)
+	}
+	s.mu.RUnlock()
+
+	for _, f := range fs {
+		f(inv)
+	}
+}
+
+// LocalInvalidator is an Invalidator for Clients in the same process. Make one with
+// NewLocalInvalidator.
+type LocalInvalidator struct {
+	subs subscribers
+}
+
+// NewLocalInvalidator makes an Invalidator which delivers invalidations to the Clients in this
+// process which use it.
+func NewLocalInvalidator() *LocalInvalidator {
+	return &LocalInvalidator{}
+}
+
+// Publish delivers an invalidation to every subscriber before it returns.
+func (l *LocalInvalidator) Publish(ctx context.Context, inv Invalidation) error {
+	l.subs.deliver(inv)
+	return nil
+}
+
+// Subscribe calls f with every invalidation published from now on, until the returned function
+// is called.
+func (l *LocalInvalidator) Subscribe(f func(inv Invalidation)) (func(), error) {
+	return l.subs.add(f), nil
+}
+
+// tcpInvalidatorTimeout is the longest a TCPInvalidator waits to connect or write to a peer. It's
+// short, since writes wait for invalidations to be sent, and peers which miss them catch up
+// after LocalCacheTTL anyway.
+const tcpInvalidatorTimeout = 500 * time.Millisecond
+
+// tcpInvalidation is an Invalidation sent between TCPInvalidators, as one line of JSON.
+type tcpInvalidation struct {
+	Source string       `json:"s"`
+	Keys   []*cachedKey `json:"k"`
+}
+
+// TCPInvalidator is an Invalidator which sends invalidations to its peers, which are other
+// TCPInvalidators, usually in other processes, over TCP. Each invalidation is one line of JSON.
+// It delivers the invalidations it receives to its own subscribers, but doesn't pass them on, so
+// every process must list all the others as peers. Make one with NewTCPInvalidator.
+type TCPInvalidator struct {
+	listener net.Listener
+	subs     subscribers
+
+	mu       sync.Mutex
+	peers    map[string]*tcpPeer
+	accepted map[net.Conn]bool
+	closed   bool
+
+	wg sync.WaitGroup
+}
+
+// tcpPeer is the connection to a TCPInvalidator's peer. It's made when it's first needed, and
+// made again if it breaks.
+type tcpPeer struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewTCPInvalidator makes a TCPInvalidator which listens for invalidations at the given address,
+// such as ":7946", and sends invalidations to the peers at the given addresses.
+func NewTCPInvalidator(addr string, peers ...string) (*TCPInvalidator, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.NewTCPInvalidator: failed listening on %v: %v", addr, err)
+	}
+
+	t := &TCPInvalidator{
+		listener: listener,
+		peers:    make(map[string]*tcpPeer),
+		accepted: make(map[net.Conn]bool),
+	}
+
+	for _, peer := range peers {
+		t.AddPeer(peer)
+	}
+
+	t.wg.Add(1)
+	go t.accept()
+
+	return t, nil
+}
+
+// Addr returns the address the invalidator listens at.
+func (t *TCPInvalidator) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// AddPeer adds a peer to send invalidations to, at the given address.
+func (t *TCPInvalidator) AddPeer(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.peers[addr]; !ok {
+		t.peers[addr] = &tcpPeer{addr: addr}
+	}
+}
+
+// Publish delivers an invalidation to the invalidator's subscribers, and sends it to all its
+// peers at once, so a slow peer only delays the others by as long as it takes to time out. It
+// returns an error if it couldn't be sent to some of them, after sending it to the others.
+func (t *TCPInvalidator) Publish(ctx context.Context, inv Invalidation) error {
+	t.subs.deliver(inv)
+
+	msg := tcpInvalidation{Source: inv.Source, Keys: make([]*cachedKey, 0, len(inv.Keys))}
+	for _, key := range inv.Keys {
+		msg.Keys = append(msg.Keys, keyToCache(key))
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("godscache.TCPInvalidator.Publish: failed encoding invalidation: %v", err)
+	}
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return errors.New("godscache.TCPInvalidator.Publish: the invalidator is closed")
+	}
+	peers := make([]*tcpPeer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.mu.Unlock()
+
+	errs := make([]error, len(peers))
+
+	var wg sync.WaitGroup
+	for idx, peer := range peers {
+		wg.Add(1)
+		go func(idx int, peer *tcpPeer) {
+			defer wg.Done()
+
+			err := peer.send(ctx, line)
+			if err != nil {
+				errs[idx] = fmt.Errorf("godscache.TCPInvalidator.Publish: failed sending invalidation to %v: %v", peer.addr, err)
+			}
+		}(idx, peer)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Subscribe calls f with every invalidation published or received from now on, until the
+// returned function is called.
+func (t *TCPInvalidator) Subscribe(f func(inv Invalidation)) (func(), error) {
+	return t.subs.add(f), nil
+}
+
+// Close stops listening, and closes the connections to and from the peers.
+func (t *TCPInvalidator) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.accepted {
+		conn.Close()
+	}
+	peers := make([]*tcpPeer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.mu.Unlock()
+
+	err := t.listener.Close()
+
+	for _, peer := range peers {
+		peer.close()
+	}
+
+	t.wg.Wait()
+
+	return err
+}
+
+// accept accepts connections from peers until the invalidator is closed.
+func (t *TCPInvalidator) accept() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.mu.Lock()
+			closed := t.closed
+			t.mu.Unlock()
+
+			if closed || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Printf("godscache.TCPInvalidator.accept: failed accepting connection: %v", err)
+			continue
+		}
+
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		t.accepted[conn] = true
+		t.mu.Unlock()
+
+		t.wg.Add(1)
+		go t.receive(conn)
+	}
+}
+
+// receive delivers the invalidations a peer sends over conn, until it's closed.
+func (t *TCPInvalidator) receive(conn net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		t.mu.Lock()
+		delete(t.accepted, conn)
+		t.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var msg tcpInvalidation
+
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			log.Printf("godscache.TCPInvalidator.receive: failed decoding invalidation from %v: %v", conn.RemoteAddr(), err)
+			continue
+		}
+
+		inv := Invalidation{Source: msg.Source, Keys: make([]*datastore.Key, 0, len(msg.Keys))}
+		for _, key := range msg.Keys {
+			inv.Keys = append(inv.Keys, keyFromCache(key))
+		}
+
+		t.subs.deliver(inv)
+	}
+}
+
+// send writes a line to the peer, connecting to it first if needed. If the connection is broken,
+// it connects again and retries once.
+func (p *tcpPeer) send(ctx context.Context, line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deadline := time.Now().Add(tcpInvalidatorTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if p.conn == nil {
+			dialer := net.Dialer{Deadline: deadline}
+
+			p.conn, err = dialer.DialContext(ctx, "tcp", p.addr)
+			if err != nil {
+				p.conn = nil
+				return err
+			}
+		}
+
+		p.conn.SetWriteDeadline(deadline)
+
+		_, err = p.conn.Write(line)
+		if err == nil {
+			return nil
+		}
+
+		p.conn.Close()
+		p.conn = nil
+	}
+
+	return err
+}
+
+// close closes the connection to the peer.
+func (p *tcpPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultLoaderWait is how long NewLoader lets a batch collect Get calls before it's loaded.
+const DefaultLoaderWait = 2 * time.Millisecond
+
+// DefaultLoaderMaxBatchSize is the most Get calls NewLoader puts in one batch.
+const DefaultLoaderMaxBatchSize = 100
+
+// Loader batches concurrent Get calls, so that many goroutines getting one entity each only make
+// one cache request, and one datastore request for the entities which aren't cached. A batch is
+// loaded once it's been collecting calls for Wait, or once it has MaxBatchSize calls, whichever
+// comes first. Make one with NewLoader, and set its fields before using it.
+type Loader struct {
+	// How long a batch collects Get calls before it's loaded.
+	Wait time.Duration
+
+	// The most Get calls in one batch. If it's 0 or less, batches are only limited by Wait.
+	MaxBatchSize int
+
+	client *Client
+
+	// The batches which are collecting calls. Calls with different caching settings, or
+	// different request caches, go in different batches.
+	mu      sync.Mutex
+	batches map[loaderBatchKey]*loaderBatch
+}
+
+// loaderBatchKey says which batch a call goes in.
+type loaderBatchKey struct {
+	cc cacheControl
+	rc *requestCache
+}
+
+// loaderBatch is a batch of Get calls which are loaded together.
+type loaderBatch struct {
+	ctx   context.Context
+	calls []loaderCall
+}
+
+// loaderCall is a Get call waiting for its batch to be loaded. The batch loads the entity into
+// value, rather than the caller's dst, since the caller may have stopped waiting for it. The
+// caller copies it into dst once it's sent its error on done.
+type loaderCall struct {
+	key   *datastore.Key
+	value reflect.Value
+	done  chan error
+}
+
+// NewLoader makes a Loader which gets entities with the given Client.
+func NewLoader(c *Client) *Loader {
+	return &Loader{
+		Wait:         DefaultLoaderWait,
+		MaxBatchSize: DefaultLoaderMaxBatchSize,
+		client:       c,
+		batches:      make(map[loaderBatchKey]*loaderBatch),
+	}
+}
+
+// Get gets the entity for key from the cache or datastore, the same way Client.Get does, but
+// together with the other Get calls made around the same time. The batch is loaded with the
+// values in ctx of the first call in it, and it isn't cancelled if ctx is. If ctx is done
+// first, Get returns its error, and dst is left untouched.
+func (l *Loader) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if key == nil {
+		return errors.New("godscache.Loader.Get: you provided a nil key")
+	}
+
+	dVal := reflect.ValueOf(dst)
+	if dVal.Kind() != reflect.Ptr || dVal.IsNil() {
+		return errors.New("godscache.Loader.Get: dst must be a non-nil pointer")
+	}
+
+	call := loaderCall{key: key, value: reflect.New(dVal.Type().Elem()), done: make(chan error, 1)}
+	bk := loaderBatchKey{cc: cacheControlFrom(ctx), rc: requestCacheFrom(ctx)}
+
+	l.mu.Lock()
+
+	b, ok := l.batches[bk]
+	if !ok {
+		b = &loaderBatch{ctx: context.WithoutCancel(ctx)}
+		l.batches[bk] = b
+
+		time.AfterFunc(l.Wait, func() {
+			if l.take(bk, b) {
+				l.load(b)
+			}
+		})
+	}
+
+	b.calls = append(b.calls, call)
+
+	// Load a full batch straight away, instead of waiting for it.
+	full := l.MaxBatchSize > 0 && len(b.calls) >= l.MaxBatchSize
+	if full {
+		delete(l.batches, bk)
+	}
+
+	l.mu.Unlock()
+
+	if full {
+		l.load(b)
+	}
+
+	select {
+	case err := <-call.done:
+		// Entities which don't match dst's type are still loaded, like with Client.Get.
+		var mismatch *datastore.ErrFieldMismatch
+		if err == nil || errors.As(err, &mismatch) {
+			dVal.Elem().Set(call.value.Elem())
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take stops a batch from collecting calls, and returns true, unless it's already been loaded.
+func (l *Loader) take(bk loaderBatchKey, b *loaderBatch) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.batches[bk] != b {
+		return false
+	}
+
+	delete(l.batches, bk)
+
+	return true
+}
+
+// load gets the entities for a batch of calls, and gives each call its result.
+func (l *Loader) load(b *loaderBatch) {
+	keys := make([]*datastore.Key, len(b.calls))
+	dsts := make([]interface{}, len(b.calls))
+	for idx, call := range b.calls {
+		keys[idx] = call.key
+		dsts[idx] = call.value.Interface()
+	}
+
+	errs := l.client.getEach(b.ctx, keys, dsts)
+
+	for idx, call := range b.calls {
+		call.done <- errs[idx]
+	}
+}
+
+// getEach gets the entities for keys into dsts, which must be pointers, with one cache request,
+// and one datastore request for the entities which aren't cached. It returns an error for each
+// entity, which is nil if it was got.
+func (c *Client) getEach(ctx context.Context, keys []*datastore.Key, dsts []interface{}) []error {
+	cc := cacheControlFrom(ctx)
+
+	errs := make([]error, len(keys))
+
+	// Get what's cached. If the cache can't be read, everything is read from the datastore.
+	hits := make([]bool, len(keys))
+	if cc.readsCache() {
+		cacheHits, cacheErrs, err := c.getMultiFromCache(ctx, keys, dsts)
+		if err != nil {
+			log.Printf("godscache.Client.getEach: failed getting multiple items from cache: %v", err)
+		} else {
+			hits = cacheHits
+			for idx, err := range cacheErrs {
+				errs[idx] = err
+			}
+		}
+	}
+
+	uncachedKeys := make([]*datastore.Key, 0)
+	uncachedIdxs := make([]int, 0)
+	for idx, key := range keys {
+		if !hits[idx] {
+			uncachedKeys = append(uncachedKeys, key)
+			uncachedIdxs = append(uncachedIdxs, idx)
+		}
+	}
+
+	if len(uncachedKeys) > 0 && cc.cacheOnly {
+		for _, idx := range uncachedIdxs {
+			errs[idx] = ErrNotCached
+		}
+	} else if len(uncachedKeys) > 0 {
+		uncachedDsts := make([]interface{}, len(uncachedIdxs))
+		for idx, dstIdx := range uncachedIdxs {
+			uncachedDsts[idx] = dsts[dstIdx]
+		}
+
+		// The datastore reports errors for single entities in a MultiError. Any other error
+		// is for all of them.
+		err := c.Store.GetMulti(ctx, uncachedKeys, uncachedDsts)
+		multiErr, isMulti := err.(datastore.MultiError)
+
+		for idx, dstIdx := range uncachedIdxs {
+			switch {
+			case isMulti && multiErr[idx] != nil:
+				errs[dstIdx] = multiErr[idx]
+			case err != nil && !isMulti:
+				errs[dstIdx] = err
+			default:
+				err := c.fillCache(ctx, uncachedKeys[idx], uncachedDsts[idx])
+				if err != nil {
+					errs[dstIdx] = fmt.Errorf("godscache.Client.getEach: failed adding item to cache: %v", err)
+				}
+			}
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultLocalCacheTTL is how long NewClient keeps entities in the local cache.
+const DefaultLocalCacheTTL = 10 * time.Second
+
+// localCache is a Client's in-process cache, in front of memcache. It keeps a limited number of
+// entities, and forgets the least recently used ones first. Its zero value is ready to use.
+type localCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// localCacheItem is an entity in the local cache.
+type localCacheItem struct {
+	keyStr string
+	entry  memoryEntry
+}
+
+// get returns the entry for a key, and marks it as the most recently used.
+func (lc *localCache) get(keyStr string) (memoryEntry, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	elem, ok := lc.entries[keyStr]
+	if !ok {
+		return memoryEntry{}, false
+	}
+
+	lc.order.MoveToFront(elem)
+
+	return elem.Value.(*localCacheItem).entry, true
+}
+
+// set replaces the entry for a key, forgetting the least recently used entries if there are
+// more than size. Nothing is kept if size is 0 or less.
+func (lc *localCache) set(keyStr string, entry memoryEntry, size int) {
+	if size <= 0 {
+		return
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.entries == nil {
+		lc.entries = make(map[string]*list.Element)
+		lc.order = list.New()
+	}
+
+	if elem, ok := lc.entries[keyStr]; ok {
+		elem.Value.(*localCacheItem).entry = entry
+		lc.order.MoveToFront(elem)
+	} else {
+		lc.entries[keyStr] = lc.order.PushFront(&localCacheItem{keyStr: keyStr, entry: entry})
+	}
+
+	for lc.order.Len() > size {
+		oldest := lc.order.Back()
+		lc.order.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*localCacheItem).keyStr)
+	}
+}
+
+// forget removes the entry for a key.
+func (lc *localCache) forget(keyStr string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if elem, ok := lc.entries[keyStr]; ok {
+		lc.order.Remove(elem)
+		delete(lc.entries, keyStr)
+	}
+}
+
+// len returns the number of entries.
+func (lc *localCache) len() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return len(lc.entries)
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// errFlightPanicked is the error waiting callers get when the function they're waiting for
+// panics.
+var errFlightPanicked = errors.New("godscache: the memoized function panicked")
+
+// flightGroup makes concurrent calls for the same key share one call of a function, so that a
+// value which isn't cached is only computed once in the process, however many callers need it.
+// Its zero value is ready to use.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is a call of a function which other callers can wait for.
+type flightCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// do calls fn and returns what it returns, unless a call for the same key is already running,
+// in which case it waits for that call and returns what it returned, and true. If ctx is done
+// first, it returns ctx's error.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, bool, error) {
+	g.mu.Lock()
+
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+
+		select {
+		case <-call.done:
+			return call.data, true, call.err
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		}
+	}
+
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+
+	g.mu.Unlock()
+
+	returned := false
+	defer func() {
+		if !returned {
+			call.err = errFlightPanicked
+		}
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+
+		close(call.done)
+	}()
+
+	call.data, call.err = fn()
+	returned = true
+
+	return call.data, false, call.err
+}
+
+// Memoize gets the value cached under cacheKey into dst, which must be a pointer to a value of
+// the type fn returns. If it isn't cached, it calls fn to compute it, caches it for ttl, or until
+// it's evicted if ttl is 0, and gets it into dst. Concurrent calls in the process for the same
+// cacheKey share one call of fn.
+//
+// Values are cached the same way as with SetTagged, with the given tags, so they can be
+// invalidated with InvalidateTags, and they're invalidated when the entity for any of the keys
+// given with KeyTag is written. If ctx is from WithCacheOnly, fn isn't called, and ErrNotCached
+// is returned if the value isn't cached.
+func (c *Client) Memoize(ctx context.Context, cacheKey string, ttl time.Duration, dst interface{}, fn func() (interface{}, error), tags ...string) error {
+	if dst == nil || reflect.ValueOf(dst).Kind() != reflect.Ptr {
+		return errors.New("godscache.Client.Memoize: dst must be a pointer")
+	}
+
+	// If the cache can't be read, the value is computed instead.
+	found, err := c.GetTagged(ctx, cacheKey, dst)
+	if err != nil {
+		log.Printf("godscache.Client.Memoize: %v", err)
+	}
+	if found {
+		return nil
+	}
+
+	if cacheControlFrom(ctx).cacheOnly {
+		return ErrNotCached
+	}
+
+	data, shared, err := c.flights.do(ctx, cacheKey, func() ([]byte, error) {
+		// The tags' versions are got before the value is computed, so that if its data is
+		// written while it's being computed, it's cached with versions which are already
+		// invalidated, rather than with new versions which aren't.
+		var versions map[string]string
+		if c.MemcacheClient != nil && !cacheControlFrom(ctx).noCache {
+			var err error
+			versions, err = c.tagVersions(tags, true)
+			if err != nil {
+				log.Printf("godscache.Client.Memoize: failed getting tag versions: %v", err)
+			}
+		}
+
+		value, err := fn()
+		if err != nil {
+			return nil, err
+		}
+
+		c.stats.computations.Add(1)
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("godscache.Client.Memoize: failed marshaling value to JSON: %v", err)
+		}
+
+		// The value has been computed, so it's returned even if it can't be cached.
+		if versions != nil {
+			err = c.setVersioned(cacheKey, value, ttl, versions)
+			if err != nil {
+				log.Printf("godscache.Client.Memoize: %v", err)
+			}
+		}
+
+		return data, nil
+	})
+	if shared {
+		c.stats.sharedComputations.Add(1)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, dst)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.Memoize: failed unmarshaling value: %v", err)
+	}
+
+	return nil
+}
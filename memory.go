@@ -0,0 +1,141 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Entities can be kept in memory in two tiers in front of memcache: the request cache attached
+// to a context, which is checked first, and the Client's local cache. Both keep entities in
+// their cached encoding, so every read gets a copy of its own.
+
+// memoryEntry is an entity kept in memory, or a record that it was deleted.
+type memoryEntry struct {
+	typ     reflect.Type
+	data    []byte
+	written time.Time
+	deleted bool
+}
+
+// entityType returns the type of the entities a value of type t holds, without any pointers.
+func entityType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// getFromMemory gets data for key from the request cache in ctx, or from the local cache, into
+// dst, which must be a pointer. It returns true if the data was found. If the entity was
+// deleted, it returns datastore.ErrNoSuchEntity. Data of a different type, or which is older
+// than the maximum staleness allowed for the key, isn't used.
+func (c *Client) getFromMemory(ctx context.Context, key *datastore.Key, dst interface{}) (bool, error) {
+	keyStr := cacheKey(key)
+
+	rc := requestCacheFrom(ctx)
+	if rc != nil {
+		if entry, ok := rc.get(keyStr); ok {
+			found, err := c.useMemoryEntry(ctx, key, entry, dst)
+			if found || err != nil {
+				return found, err
+			}
+		}
+	}
+
+	entry, ok := c.local.get(keyStr)
+	if !ok || (c.LocalCacheTTL > 0 && time.Since(entry.written) > c.LocalCacheTTL) {
+		return false, nil
+	}
+
+	found, err := c.useMemoryEntry(ctx, key, entry, dst)
+	if found && rc != nil {
+		rc.fill(keyStr, entry)
+	}
+
+	return found, err
+}
+
+// useMemoryEntry decodes an entry kept in memory for key into dst, if it can be used.
+func (c *Client) useMemoryEntry(ctx context.Context, key *datastore.Key, entry memoryEntry, dst interface{}) (bool, error) {
+	if entry.deleted {
+		c.stats.hits.Add(1)
+		return false, datastore.ErrNoSuchEntity
+	}
+
+	if maxStaleness := c.maxStaleness(ctx, key.Kind); maxStaleness > 0 && time.Since(entry.written) > maxStaleness {
+		return false, nil
+	}
+
+	if entry.typ != entityType(reflect.TypeOf(dst)) {
+		return false, nil
+	}
+
+	err := unmarshalEntity(key, entry.data, dst)
+	if err != nil {
+		c.deleteFromMemory(ctx, []*datastore.Key{key}, false)
+		return false, nil
+	}
+
+	c.stats.hits.Add(1)
+
+	return true, nil
+}
+
+// addToMemory keeps data for key in the request cache in ctx, if there is one, and in the local
+// cache, if the client has one. If fill is true, the data was read rather than written, so it
+// doesn't replace the request cache's record that the entity was deleted.
+func (c *Client) addToMemory(ctx context.Context, key *datastore.Key, data interface{}, fill bool) {
+	if requestCacheFrom(ctx) == nil && c.LocalCacheSize <= 0 {
+		return
+	}
+
+	dataBytes, err := marshalEntity(data)
+	if err != nil {
+		c.deleteFromMemory(ctx, []*datastore.Key{key}, false)
+		return
+	}
+
+	c.addEncodedToMemory(ctx, key, reflect.TypeOf(data), dataBytes, time.Now(), fill)
+}
+
+// addEncodedToMemory keeps data for key, which is encoded from a value of type t, and was cached
+// at the given time, in the request cache in ctx and the local cache. If fill is true, it's kept
+// the same way as by addToMemory.
+func (c *Client) addEncodedToMemory(ctx context.Context, key *datastore.Key, t reflect.Type, data []byte, written time.Time, fill bool) {
+	keyStr := cacheKey(key)
+	entry := memoryEntry{typ: entityType(t), data: data, written: written}
+
+	if rc := requestCacheFrom(ctx); rc != nil && fill {
+		rc.fill(keyStr, entry)
+	} else if rc != nil {
+		rc.set(keyStr, entry)
+	}
+
+	c.local.set(keyStr, entry, c.LocalCacheSize)
+}
+
+// deleteFromMemory removes keys from the request cache in ctx and the local cache. If deleted
+// is true, the request cache records that their entities were deleted instead. The local cache
+// doesn't, since other processes may put them again.
+func (c *Client) deleteFromMemory(ctx context.Context, keys []*datastore.Key, deleted bool) {
+	rc := requestCacheFrom(ctx)
+
+	for _, key := range keys {
+		keyStr := cacheKey(key)
+
+		if rc != nil && deleted {
+			rc.set(keyStr, memoryEntry{deleted: true})
+		} else if rc != nil {
+			rc.forget(keyStr)
+		}
+
+		c.local.forget(keyStr)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"cloud.google.com/go/datastore"
+)
+
+// Mutation is a datastore.Mutation for Client.Mutate, along with the key it affects and whether
+// it's a delete, which datastore.Mutations don't say. Client.Mutate needs them to update the
+// cache the same way as Put and Delete. Make one with NewInsert, NewUpdate, NewUpsert or
+// NewDelete.
+type Mutation struct {
+	mut    *datastore.Mutation
+	key    *datastore.Key
+	delete bool
+}
+
+// NewInsert returns a mutation which inserts src for key, like datastore.NewInsert.
+func NewInsert(key *datastore.Key, src interface{}) *Mutation {
+	return &Mutation{mut: datastore.NewInsert(key, src), key: key}
+}
+
+// NewUpdate returns a mutation which replaces the existing entity for key with src, like
+// datastore.NewUpdate.
+func NewUpdate(key *datastore.Key, src interface{}) *Mutation {
+	return &Mutation{mut: datastore.NewUpdate(key, src), key: key}
+}
+
+// NewUpsert returns a mutation which saves src for key, whether or not it exists, like
+// datastore.NewUpsert.
+func NewUpsert(key *datastore.Key, src interface{}) *Mutation {
+	return &Mutation{mut: datastore.NewUpsert(key, src), key: key}
+}
+
+// NewDelete returns a mutation which deletes the entity for key, like datastore.NewDelete.
+func NewDelete(key *datastore.Key) *Mutation {
+	return &Mutation{mut: datastore.NewDelete(key), key: key, delete: true}
+}
+
+// WithTransforms adds server-side property transformations to the mutation, the same way as
+// datastore.Mutation.WithTransforms.
+func (m *Mutation) WithTransforms(transforms ...datastore.PropertyTransform) *Mutation {
+	m.mut.WithTransforms(transforms...)
+	return m
+}
+
+// WithPropertyMask limits the properties the mutation writes, the same way as
+// datastore.Mutation.WithPropertyMask.
+func (m *Mutation) WithPropertyMask(paths ...string) *Mutation {
+	m.mut.WithPropertyMask(paths...)
+	return m
+}
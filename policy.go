@@ -0,0 +1,100 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"time"
+)
+
+// WriteStrategy says how the cache is updated when entities are written to the datastore.
+type WriteStrategy int
+
+const (
+	// DefaultWriteStrategy uses the Client's WriteStrategy for a kind, or WriteThrough if the
+	// Client's WriteStrategy is DefaultWriteStrategy too.
+	DefaultWriteStrategy WriteStrategy = iota
+
+	// WriteThrough writes entities into the cache after writing them to the datastore.
+	WriteThrough
+
+	// InvalidateOnWrite deletes entities from the cache after writing them to the datastore, so
+	// that the next read caches them again. Reads only add entities to the cache if they
+	// aren't in it already, so a slow read can't overwrite what a faster read cached. This
+	// keeps the cache closer to the datastore when entities are written concurrently, at the
+	// cost of a cache miss after every write.
+	InvalidateOnWrite
+)
+
+// KindPolicy holds the caching settings for one kind of entity. Its zero value uses the Client's
+// settings.
+type KindPolicy struct {
+	// How the cache is updated when entities of the kind are written.
+	WriteStrategy WriteStrategy
+
+	// The longest time entities of the kind can be served from the cache after they were
+	// cached. Older entities are read from the datastore again. If it's 0, the Client's
+	// MaxAge is used.
+	MaxAge time.Duration
+
+	// How long after entities of the kind are cached they're refreshed in the background when
+	// they're read. Until their MaxAge, reads still get what's cached, without waiting for the
+	// datastore. If it's 0, the Client's SoftTTL is used.
+	SoftTTL time.Duration
+
+	// How long before their MaxAge entities of the kind are refreshed in the background when
+	// they're read, so that entities which are read often are never read from the datastore
+	// while a caller waits. If it's 0, the Client's RefreshAhead is used.
+	RefreshAhead time.Duration
+}
+
+// SetKindPolicy sets the caching settings for entities of the given kind, overriding the Client's
+// settings. It's safe to call while the client is in use.
+func (c *Client) SetKindPolicy(kind string, policy KindPolicy) {
+	c.policiesMu.Lock()
+	defer c.policiesMu.Unlock()
+
+	if c.policies == nil {
+		c.policies = make(map[string]KindPolicy)
+	}
+
+	c.policies[kind] = policy
+}
+
+// KindPolicy returns the caching settings set for entities of the given kind by SetKindPolicy.
+func (c *Client) KindPolicy(kind string) KindPolicy {
+	c.policiesMu.RLock()
+	defer c.policiesMu.RUnlock()
+
+	return c.policies[kind]
+}
+
+// writeStrategy returns the write strategy to use for entities of the given kind.
+func (c *Client) writeStrategy(kind string) WriteStrategy {
+	if strategy := c.KindPolicy(kind).WriteStrategy; strategy != DefaultWriteStrategy {
+		return strategy
+	}
+
+	if c.WriteStrategy != DefaultWriteStrategy {
+		return c.WriteStrategy
+	}
+
+	return WriteThrough
+}
+
+// maxStaleness returns the longest time an entity of the given kind can have been cached for,
+// and still be served from the cache. A maximum set in ctx with WithMaxStaleness takes priority
+// over the kind's MaxAge, which takes priority over the Client's. It returns 0 if there's no
+// maximum.
+func (c *Client) maxStaleness(ctx context.Context, kind string) time.Duration {
+	if maxStaleness := cacheControlFrom(ctx).maxStaleness; maxStaleness > 0 {
+		return maxStaleness
+	}
+
+	if maxAge := c.KindPolicy(kind).MaxAge; maxAge > 0 {
+		return maxAge
+	}
+
+	return c.MaxAge
+}
@@ -0,0 +1,349 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Entities are cached as JSON. Structs are marshaled the way encoding/json does it, but
+// datastore.PropertyList values, and types which implement datastore.PropertyLoadSaver, are
+// cached as their datastore properties, with the type of each value recorded so it can be
+// restored exactly.
+
+// cachedProperty is a datastore.Property in the cache.
+type cachedProperty struct {
+	Name    string      `json:"n"`
+	NoIndex bool        `json:"x,omitempty"`
+	Value   cachedValue `json:"v"`
+}
+
+// cachedValue is the value of a datastore.Property in the cache. Type says which of the other
+// fields holds the value.
+type cachedValue struct {
+	Type   string              `json:"t"`
+	Int    int64               `json:"i,omitempty"`
+	Bool   bool                `json:"b,omitempty"`
+	String string              `json:"s,omitempty"`
+	Float  uint64              `json:"f,omitempty"`
+	Key    *cachedKey          `json:"k,omitempty"`
+	Time   *time.Time          `json:"m,omitempty"`
+	Geo    *datastore.GeoPoint `json:"g,omitempty"`
+	Bytes  []byte              `json:"y,omitempty"`
+	Entity *cachedEntityValue  `json:"e,omitempty"`
+	Array  []cachedValue       `json:"a,omitempty"`
+}
+
+// cachedEntityValue is a *datastore.Entity property value in the cache.
+type cachedEntityValue struct {
+	Key        *cachedKey       `json:"k,omitempty"`
+	Properties []cachedProperty `json:"p"`
+}
+
+// cachedKey is a *datastore.Key in the cache. Keys aren't cached with their own JSON encoding,
+// because it leaves out the namespace.
+type cachedKey struct {
+	Kind      string     `json:"k"`
+	ID        int64      `json:"i,omitempty"`
+	Name      string     `json:"n,omitempty"`
+	Namespace string     `json:"s,omitempty"`
+	Parent    *cachedKey `json:"p,omitempty"`
+}
+
+// keyToCache converts a datastore key to its cached form.
+func keyToCache(key *datastore.Key) *cachedKey {
+	if key == nil {
+		return nil
+	}
+
+	return &cachedKey{
+		Kind:      key.Kind,
+		ID:        key.ID,
+		Name:      key.Name,
+		Namespace: key.Namespace,
+		Parent:    keyToCache(key.Parent),
+	}
+}
+
+// keyFromCache converts a cached key back to a datastore key.
+func keyFromCache(key *cachedKey) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+
+	return &datastore.Key{
+		Kind:      key.Kind,
+		ID:        key.ID,
+		Name:      key.Name,
+		Namespace: key.Namespace,
+		Parent:    keyFromCache(key.Parent),
+	}
+}
+
+// The types of cached property values.
+const (
+	propertyNil    = "nil"
+	propertyInt    = "int"
+	propertyBool   = "bool"
+	propertyString = "string"
+	propertyFloat  = "float"
+	propertyKey    = "key"
+	propertyTime   = "time"
+	propertyGeo    = "geo"
+	propertyBytes  = "bytes"
+	propertyEntity = "entity"
+	propertyArray  = "array"
+)
+
+// propertyLoadSaverType is the type of datastore.PropertyLoadSaver.
+var propertyLoadSaverType = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
+
+// marshalEntity returns the JSON encoding of an entity to cache.
+func marshalEntity(data interface{}) ([]byte, error) {
+	props, ok, err := saveProperties(data)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.marshalEntity: failed getting properties: %v", err)
+	}
+
+	if !ok {
+		return json.Marshal(data)
+	}
+
+	cached, err := propertiesToCache(props)
+	if err != nil {
+		return nil, fmt.Errorf("godscache.marshalEntity: %v", err)
+	}
+
+	return json.Marshal(cached)
+}
+
+// saveProperties returns the properties of data, and true, if data is a datastore.PropertyList
+// or a datastore.PropertyLoadSaver, or a pointer to one. Otherwise it returns false.
+func saveProperties(data interface{}) ([]datastore.Property, bool, error) {
+	switch d := data.(type) {
+	case datastore.PropertyList:
+		return d, true, nil
+	case *datastore.PropertyList:
+		return *d, true, nil
+	case datastore.PropertyLoadSaver:
+		props, err := d.Save()
+		return props, true, err
+	}
+
+	// Structs which implement datastore.PropertyLoadSaver with pointer receivers can be saved
+	// through a pointer to a copy.
+	v := reflect.ValueOf(data)
+	if v.IsValid() && v.Kind() != reflect.Ptr && reflect.PointerTo(v.Type()).Implements(propertyLoadSaverType) {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+
+		props, err := p.Interface().(datastore.PropertyLoadSaver).Save()
+		return props, true, err
+	}
+
+	return nil, false, nil
+}
+
+// unmarshalEntity decodes the JSON encoding of a cached entity with the given key into dst,
+// which must be a pointer. Nil pointers it points to are allocated. A datastore.KeyLoader is
+// given the entity's key, the same way the datastore would.
+func unmarshalEntity(key *datastore.Key, data []byte, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	for v.Elem().Kind() == reflect.Ptr {
+		if v.Elem().IsNil() {
+			v.Elem().Set(reflect.New(v.Elem().Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	switch d := v.Interface().(type) {
+	case *datastore.PropertyList:
+		props, err := unmarshalProperties(data)
+		if err != nil {
+			return err
+		}
+
+		*d = props
+
+	case datastore.PropertyLoadSaver:
+		props, err := unmarshalProperties(data)
+		if err != nil {
+			return err
+		}
+
+		err = d.Load(props)
+		if err != nil {
+			return fmt.Errorf("godscache.unmarshalEntity: failed loading properties: %v", err)
+		}
+
+		if kl, ok := d.(datastore.KeyLoader); ok {
+			err = kl.LoadKey(key)
+			if err != nil {
+				return fmt.Errorf("godscache.unmarshalEntity: failed loading key: %v", err)
+			}
+		}
+
+	default:
+		return json.Unmarshal(data, dst)
+	}
+
+	return nil
+}
+
+// unmarshalProperties decodes the JSON encoding of cached properties.
+func unmarshalProperties(data []byte) (datastore.PropertyList, error) {
+	var cached []cachedProperty
+
+	err := json.Unmarshal(data, &cached)
+	if err != nil {
+		return nil, err
+	}
+
+	return propertiesFromCache(cached)
+}
+
+// propertiesToCache converts datastore properties to their cached form.
+func propertiesToCache(props []datastore.Property) ([]cachedProperty, error) {
+	cached := make([]cachedProperty, 0, len(props))
+
+	for _, prop := range props {
+		value, err := propertyValueToCache(prop.Value)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %v", prop.Name, err)
+		}
+
+		cached = append(cached, cachedProperty{Name: prop.Name, NoIndex: prop.NoIndex, Value: value})
+	}
+
+	return cached, nil
+}
+
+// propertyValueToCache converts a datastore property value to its cached form.
+func propertyValueToCache(value interface{}) (cachedValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return cachedValue{Type: propertyNil}, nil
+	case int64:
+		return cachedValue{Type: propertyInt, Int: v}, nil
+	case bool:
+		return cachedValue{Type: propertyBool, Bool: v}, nil
+	case string:
+		return cachedValue{Type: propertyString, String: v}, nil
+	case float64:
+		return cachedValue{Type: propertyFloat, Float: math.Float64bits(v)}, nil
+	case *datastore.Key:
+		return cachedValue{Type: propertyKey, Key: keyToCache(v)}, nil
+	case time.Time:
+		// The datastore only keeps times to the microsecond.
+		v = v.Truncate(time.Microsecond)
+		return cachedValue{Type: propertyTime, Time: &v}, nil
+	case datastore.GeoPoint:
+		return cachedValue{Type: propertyGeo, Geo: &v}, nil
+	case []byte:
+		return cachedValue{Type: propertyBytes, Bytes: v}, nil
+	case *datastore.Entity:
+		if v == nil {
+			return cachedValue{Type: propertyEntity}, nil
+		}
+
+		props, err := propertiesToCache(v.Properties)
+		if err != nil {
+			return cachedValue{}, err
+		}
+
+		return cachedValue{Type: propertyEntity, Entity: &cachedEntityValue{Key: keyToCache(v.Key), Properties: props}}, nil
+	case []interface{}:
+		values := make([]cachedValue, 0, len(v))
+		for _, elem := range v {
+			cached, err := propertyValueToCache(elem)
+			if err != nil {
+				return cachedValue{}, err
+			}
+			values = append(values, cached)
+		}
+
+		return cachedValue{Type: propertyArray, Array: values}, nil
+	}
+
+	return cachedValue{}, fmt.Errorf("unsupported property value type: %T", value)
+}
+
+// propertiesFromCache converts cached properties back to datastore properties.
+func propertiesFromCache(cached []cachedProperty) (datastore.PropertyList, error) {
+	props := make(datastore.PropertyList, 0, len(cached))
+
+	for _, prop := range cached {
+		value, err := propertyValueFromCache(prop.Value)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %v", prop.Name, err)
+		}
+
+		props = append(props, datastore.Property{Name: prop.Name, Value: value, NoIndex: prop.NoIndex})
+	}
+
+	return props, nil
+}
+
+// propertyValueFromCache converts a cached property value back to a datastore property value.
+func propertyValueFromCache(cached cachedValue) (interface{}, error) {
+	switch cached.Type {
+	case propertyNil:
+		return nil, nil
+	case propertyInt:
+		return cached.Int, nil
+	case propertyBool:
+		return cached.Bool, nil
+	case propertyString:
+		return cached.String, nil
+	case propertyFloat:
+		return math.Float64frombits(cached.Float), nil
+	case propertyKey:
+		return keyFromCache(cached.Key), nil
+	case propertyTime:
+		if cached.Time == nil {
+			return nil, fmt.Errorf("time value is missing")
+		}
+		return cached.Time.UTC(), nil
+	case propertyGeo:
+		if cached.Geo == nil {
+			return nil, fmt.Errorf("geo point value is missing")
+		}
+		return *cached.Geo, nil
+	case propertyBytes:
+		if cached.Bytes == nil {
+			return []byte{}, nil
+		}
+		return cached.Bytes, nil
+	case propertyEntity:
+		if cached.Entity == nil {
+			return (*datastore.Entity)(nil), nil
+		}
+
+		props, err := propertiesFromCache(cached.Entity.Properties)
+		if err != nil {
+			return nil, err
+		}
+
+		return &datastore.Entity{Key: keyFromCache(cached.Entity.Key), Properties: props}, nil
+	case propertyArray:
+		values := make([]interface{}, 0, len(cached.Array))
+		for _, elem := range cached.Array {
+			value, err := propertyValueFromCache(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unknown property value type: %q", cached.Type)
+}
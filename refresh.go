@@ -0,0 +1,191 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultRefreshWorkers is the number of background refreshes NewClient lets run at once.
+const DefaultRefreshWorkers = 4
+
+// refreshQueueSize is the number of background refreshes which can wait for a worker. Refreshes
+// which don't fit are dropped, and the stale entities are refreshed by a later read instead.
+const refreshQueueSize = 1024
+
+// refresher runs background refreshes of cached entities with a bounded pool of workers. Its
+// zero value is ready to use, and the workers are started by the first refresh.
+type refresher struct {
+	mu      sync.Mutex
+	closed  bool
+	jobs    chan refreshJob
+	pending map[string]bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// refreshJob is a request to refresh the cached entity for key, which is read from the datastore
+// into a new value of type typ.
+type refreshJob struct {
+	ctx context.Context
+	key *datastore.Key
+	typ reflect.Type
+}
+
+// refreshAfter returns how long after being cached an entity of the given kind is refreshed in
+// the background when it's read. That's its SoftTTL, or RefreshAhead before its maximum
+// staleness if that's sooner. It returns 0 if entities of the kind aren't refreshed in the
+// background.
+func (c *Client) refreshAfter(ctx context.Context, kind string) time.Duration {
+	policy := c.KindPolicy(kind)
+
+	softTTL := policy.SoftTTL
+	if softTTL <= 0 {
+		softTTL = c.SoftTTL
+	}
+
+	refreshAhead := policy.RefreshAhead
+	if refreshAhead <= 0 {
+		refreshAhead = c.RefreshAhead
+	}
+
+	after := softTTL
+	if maxStaleness := c.maxStaleness(ctx, kind); refreshAhead > 0 && maxStaleness > refreshAhead {
+		if ahead := maxStaleness - refreshAhead; after <= 0 || ahead < after {
+			after = ahead
+		}
+	}
+
+	if after < 0 {
+		return 0
+	}
+
+	return after
+}
+
+// scheduleRefresh queues a background refresh of the cached entity for key, unless one is
+// already waiting or running, so that many reads of a stale entity only cause one datastore
+// read. The refresh keeps the values in ctx, but isn't cancelled with it. Values of type typ
+// are what the entity is cached as.
+func (c *Client) scheduleRefresh(ctx context.Context, key *datastore.Key, typ reflect.Type) {
+	if c.RefreshWorkers <= 0 {
+		return
+	}
+
+	r := &c.refresher
+	keyStr := cacheKey(key)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.pending[keyStr] {
+		return
+	}
+
+	// Start the workers the first time they're needed.
+	if r.jobs == nil {
+		r.jobs = make(chan refreshJob, refreshQueueSize)
+		r.pending = make(map[string]bool)
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+
+		for i := 0; i < c.RefreshWorkers; i++ {
+			r.wg.Add(1)
+			go c.refreshWorker()
+		}
+	}
+
+	select {
+	case r.jobs <- refreshJob{ctx: context.WithoutCancel(ctx), key: key, typ: typ}:
+		r.pending[keyStr] = true
+	default:
+		log.Printf("godscache.Client.scheduleRefresh: too many refreshes are waiting, not refreshing %v", key)
+	}
+}
+
+// refreshWorker runs queued refreshes until the refresher is stopped.
+func (c *Client) refreshWorker() {
+	r := &c.refresher
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case job := <-r.jobs:
+			c.refresh(job)
+		}
+	}
+}
+
+// refresh reads the entity for a refresh job from the datastore, and replaces what's cached for
+// it. It's cancelled if the refresher is stopped.
+func (c *Client) refresh(job refreshJob) {
+	r := &c.refresher
+	keyStr := cacheKey(job.key)
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, keyStr)
+		r.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+	defer context.AfterFunc(r.ctx, cancel)()
+
+	typ := job.typ
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	dst := reflect.New(typ).Interface()
+
+	err := c.Store.Get(ctx, job.key, dst)
+	if errors.Is(err, datastore.ErrNoSuchEntity) {
+		c.deleteFromMemory(ctx, []*datastore.Key{job.key}, false)
+
+		err = c.replaceWithTombstone(job.key)
+		if err != nil {
+			log.Printf("godscache.Client.refresh: failed caching tombstone for %v: %v", job.key, err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("godscache.Client.refresh: failed getting data for %v from datastore: %v", job.key, err)
+		return
+	}
+
+	stored, err := c.addToCache(job.key, dst, storeReplace)
+	if err != nil {
+		log.Printf("godscache.Client.refresh: failed adding data for %v to cache: %v", job.key, err)
+		return
+	}
+
+	if stored {
+		c.addToMemory(ctx, job.key, dst, true)
+	}
+
+	c.stats.refreshes.Add(1)
+}
+
+// stop stops the refresher's workers, cancelling the refreshes they're running and dropping
+// the ones which are waiting, and waits for them to return. Nothing is refreshed after it's
+// stopped.
+func (r *refresher) stop() {
+	r.mu.Lock()
+	r.closed = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
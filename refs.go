@@ -0,0 +1,297 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Entities often refer to other entities by their keys, such as a post's author. A key field
+// tagged with `godscache:"ref=Author"` names its companion field, Author, which LoadRefs fills
+// with the entity the key refers to. A *datastore.Key field's companion is a struct, or a pointer
+// to one, and a []*datastore.Key field's companion is a slice of them. Companion fields should be
+// tagged with `datastore:"-" json:"-"`, so they're neither saved in the datastore nor cached with
+// the entities which refer to them.
+//
+//	type Post struct {
+//		AuthorKey *datastore.Key `godscache:"ref=Author"`
+//		Author    *User          `datastore:"-" json:"-"`
+//	}
+
+// keyType and keysType are the types of key fields which can refer to other entities.
+var (
+	keyType  = reflect.TypeOf((*datastore.Key)(nil))
+	keysType = reflect.TypeOf([]*datastore.Key(nil))
+)
+
+// tagOption returns the value of an option in a struct field's godscache tag, such as "Author"
+// for the ref option in `godscache:"ref=Author"`, and whether the field has the option.
+func tagOption(field reflect.StructField, name string) (string, bool) {
+	tag, ok := field.Tag.Lookup("godscache")
+	if !ok {
+		return "", false
+	}
+
+	for _, opt := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		if strings.TrimSpace(key) == name {
+			return strings.TrimSpace(value), true
+		}
+	}
+
+	return "", false
+}
+
+// refSite is a companion field which is waiting for the entities its key field refers to.
+type refSite struct {
+	companion reflect.Value
+	keys      []*datastore.Key
+	many      bool
+
+	// The type of the companion, or of its elements if it's a slice, and the struct type it
+	// holds, which may be the same.
+	elem   reflect.Type
+	entity reflect.Type
+}
+
+// refLevel is the entities loaded for the companion fields of one level of entities.
+type refLevel struct {
+	sites []refSite
+	idxs  map[refID]int
+	dsts  []interface{}
+	errs  []error
+}
+
+// refID identifies an entity loaded for a companion field, which is loaded once for each type
+// it's loaded into.
+type refID struct {
+	entity reflect.Type
+	key    string
+}
+
+// appendRefSites appends the companion fields of an entity, which is a struct, or a pointer to
+// one, to sites. Entities which aren't structs, such as datastore.PropertyLists, have none.
+func appendRefSites(sites []refSite, v reflect.Value) ([]refSite, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return sites, nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return sites, nil
+	}
+
+	t := v.Type()
+
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+
+		name, ok := tagOption(field, "ref")
+		if !ok {
+			continue
+		}
+
+		if !field.IsExported() {
+			return nil, fmt.Errorf("%v.%v must be exported to have a ref", t, field.Name)
+		}
+
+		companionField, ok := t.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("%v.%v refers to %v, which isn't a field", t, field.Name, name)
+		}
+
+		site := refSite{companion: v.FieldByIndex(companionField.Index), elem: companionField.Type}
+
+		switch field.Type {
+		case keyType:
+			if key := v.Field(idx).Interface().(*datastore.Key); key != nil {
+				site.keys = []*datastore.Key{key}
+			}
+		case keysType:
+			if site.elem.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("%v.%v must be a slice, since %v.%v is", t, name, t, field.Name)
+			}
+			site.keys = v.Field(idx).Interface().([]*datastore.Key)
+			site.many = true
+			site.elem = site.elem.Elem()
+		default:
+			return nil, fmt.Errorf("%v.%v must be a *datastore.Key or []*datastore.Key to have a ref", t, field.Name)
+		}
+
+		site.entity = site.elem
+		if site.entity.Kind() == reflect.Ptr {
+			site.entity = site.entity.Elem()
+		}
+
+		if site.entity.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%v.%v must hold structs or struct pointers", t, name)
+		}
+
+		if !site.companion.CanSet() {
+			return nil, fmt.Errorf("%v.%v can't be set", t, name)
+		}
+
+		sites = append(sites, site)
+	}
+
+	return sites, nil
+}
+
+// LoadRefs fills the companion fields of src with the entities their key fields refer to, then
+// the companion fields of those entities, and so on, to the given depth. The src value must be a
+// struct pointer, or a slice like the dst of GetMulti. The entities at each depth are got with
+// one batched request to the cache, and one to the datastore for those which aren't cached.
+// Entities which don't exist are left out, leaving their companion fields, or their elements,
+// set to their zero values. Any other error getting them, such as ErrNotCached, is returned.
+func (c *Client) LoadRefs(ctx context.Context, src interface{}, depth int) error {
+	v := reflect.ValueOf(src)
+
+	var entities []reflect.Value
+	switch v.Kind() {
+	case reflect.Ptr:
+		entities = []reflect.Value{v}
+	case reflect.Slice:
+		for idx := 0; idx < v.Len(); idx++ {
+			entities = append(entities, v.Index(idx))
+		}
+	default:
+		return errors.New("godscache.Client.LoadRefs: src must be a struct pointer or a slice")
+	}
+
+	var levels []refLevel
+
+	for ; depth > 0 && len(entities) > 0; depth-- {
+		level := refLevel{idxs: make(map[refID]int)}
+
+		for _, entity := range entities {
+			var err error
+			level.sites, err = appendRefSites(level.sites, entity)
+			if err != nil {
+				return fmt.Errorf("godscache.Client.LoadRefs: %v", err)
+			}
+		}
+
+		var keys []*datastore.Key
+		for _, site := range level.sites {
+			for _, key := range site.keys {
+				if key == nil || key.Incomplete() {
+					continue
+				}
+
+				id := refID{entity: site.entity, key: cacheKey(key)}
+				if _, ok := level.idxs[id]; ok {
+					continue
+				}
+
+				level.idxs[id] = len(keys)
+				keys = append(keys, key)
+				level.dsts = append(level.dsts, reflect.New(site.entity).Interface())
+			}
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		level.errs = c.getEach(ctx, keys, level.dsts)
+
+		entities = entities[:0]
+		for idx, err := range level.errs {
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("godscache.Client.LoadRefs: failed getting %v: %w", keys[idx], err)
+			}
+
+			entities = append(entities, reflect.ValueOf(level.dsts[idx]))
+		}
+
+		levels = append(levels, level)
+	}
+
+	// The deepest companion fields are filled first, so that companion fields which hold
+	// copies of entities, rather than pointers to them, get their companion fields too.
+	for idx := len(levels) - 1; idx >= 0; idx-- {
+		levels[idx].fill()
+	}
+
+	return nil
+}
+
+// fill sets the companion fields of a level to the entities loaded for them.
+func (l *refLevel) fill() {
+	for _, site := range l.sites {
+		value := func(key *datastore.Key) reflect.Value {
+			if key == nil {
+				return reflect.Zero(site.elem)
+			}
+
+			idx, ok := l.idxs[refID{entity: site.entity, key: cacheKey(key)}]
+			if !ok || l.errs[idx] != nil {
+				return reflect.Zero(site.elem)
+			}
+
+			loaded := reflect.ValueOf(l.dsts[idx])
+			if site.elem.Kind() == reflect.Ptr {
+				return loaded
+			}
+
+			return loaded.Elem()
+		}
+
+		if !site.many {
+			var key *datastore.Key
+			if len(site.keys) > 0 {
+				key = site.keys[0]
+			}
+
+			site.companion.Set(value(key))
+			continue
+		}
+
+		values := reflect.MakeSlice(site.companion.Type(), len(site.keys), len(site.keys))
+		for idx, key := range site.keys {
+			values.Index(idx).Set(value(key))
+		}
+
+		site.companion.Set(values)
+	}
+}
+
+// GetWithRefs gets an entity the same way as Get, then fills its companion fields the same way
+// as LoadRefs, to the given depth.
+func (c *Client) GetWithRefs(ctx context.Context, key *datastore.Key, dst interface{}, depth int) error {
+	err := c.Get(ctx, key, dst)
+	if err != nil {
+		return err
+	}
+
+	return c.LoadRefs(ctx, dst, depth)
+}
+
+// GetMultiWithRefs gets entities the same way as GetMulti, then fills their companion fields the
+// same way as LoadRefs, to the given depth. If GetMulti returns a datastore.MultiError, the
+// companion fields of the entities which were got are still filled, then it's returned.
+func (c *Client) GetMultiWithRefs(ctx context.Context, keys []*datastore.Key, dst interface{}, depth int) error {
+	err := c.GetMulti(ctx, keys, dst)
+	if _, isMulti := err.(datastore.MultiError); err != nil && !isMulti {
+		return err
+	}
+
+	refErr := c.LoadRefs(ctx, dst, depth)
+	if refErr != nil {
+		return refErr
+	}
+
+	return err
+}
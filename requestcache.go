@@ -0,0 +1,101 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// ctxKeyRequestCache is a type for the context key used to attach a request cache.
+type ctxKeyRequestCache string
+
+// requestCacheKey is the context key for a request cache.
+const requestCacheKey = ctxKeyRequestCache("requestCache")
+
+// requestCache holds the entities read and written with one context, in memory, so that reading
+// them again with it doesn't need a memcache request. Entities are kept in their cached
+// encoding, so every read gets a copy of its own.
+type requestCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	done    bool
+}
+
+// WithRequestCache returns a context with a new request cache attached. Client calls made with
+// it, or with contexts made from it, check the request cache before memcache, and keep the
+// entities they read and write in it, so each entity only has to be read from memcache once.
+// The request cache lives as long as the context is used, so it's meant for contexts which
+// only last for one request. Middleware attaches one to each HTTP request.
+func WithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey, &requestCache{entries: make(map[string]memoryEntry)})
+}
+
+// Middleware returns an HTTP handler which attaches a request cache to each request's context,
+// as WithRequestCache does, before calling next. The request cache is discarded when next
+// returns, and isn't used by anything which keeps the request's context after that.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithRequestCache(r.Context())
+		defer requestCacheFrom(ctx).discard()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestCacheFrom returns the request cache attached to ctx, or nil if there isn't one.
+func requestCacheFrom(ctx context.Context) *requestCache {
+	rc, _ := ctx.Value(requestCacheKey).(*requestCache)
+	return rc
+}
+
+// get returns the entry for a key.
+func (rc *requestCache) get(keyStr string) (memoryEntry, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	entry, ok := rc.entries[keyStr]
+
+	return entry, ok
+}
+
+// set replaces the entry for a key, unless the request cache was discarded.
+func (rc *requestCache) set(keyStr string, entry memoryEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if !rc.done {
+		rc.entries[keyStr] = entry
+	}
+}
+
+// fill sets the entry for a key to what was read for it, unless the request cache was discarded,
+// or the entry records that the entity was deleted. The entity may have been read before it was
+// deleted, so only writes replace those.
+func (rc *requestCache) fill(keyStr string, entry memoryEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if !rc.done && !rc.entries[keyStr].deleted {
+		rc.entries[keyStr] = entry
+	}
+}
+
+// forget removes the entry for a key.
+func (rc *requestCache) forget(keyStr string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	delete(rc.entries, keyStr)
+}
+
+// discard empties the request cache, and stops it from keeping anything else.
+func (rc *requestCache) discard() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.entries = nil
+	rc.done = true
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds counts of what a Client's cache has been doing since the Client was made.
+type Stats struct {
+	// Hits is the number of entities which were found in the cache.
+	Hits uint64
+
+	// Misses is the number of entities which weren't found in the cache, or which couldn't be
+	// used, and had to be read from the datastore.
+	Misses uint64
+
+	// CorruptEntries is the number of cached entities which couldn't be decoded, and were
+	// deleted from the cache.
+	CorruptEntries uint64
+
+	// Refreshes is the number of cached entities which were refreshed in the background.
+	Refreshes uint64
+
+	// Computations is the number of values Memoize computed because they weren't cached.
+	Computations uint64
+
+	// SharedComputations is the number of Memoize calls which waited for another call to
+	// compute their value, instead of computing it themselves.
+	SharedComputations uint64
+}
+
+// clientStats holds the counters behind a Client's Stats.
+type clientStats struct {
+	hits               atomic.Uint64
+	misses             atomic.Uint64
+	corruptEntries     atomic.Uint64
+	refreshes          atomic.Uint64
+	computations       atomic.Uint64
+	sharedComputations atomic.Uint64
+}
+
+// Stats returns the counts of what the client's cache has been doing.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Hits:               c.stats.hits.Load(),
+		Misses:             c.stats.misses.Load(),
+		CorruptEntries:     c.stats.corruptEntries.Load(),
+		Refreshes:          c.stats.refreshes.Load(),
+		Computations:       c.stats.computations.Load(),
+		SharedComputations: c.stats.sharedComputations.Load(),
+	}
+}
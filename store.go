@@ -0,0 +1,143 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Store is the datastore that a godscache Client adds caching to. It has the same methods as the
+// Google Cloud Datastore client, so NewDatastoreStore can adapt a *datastore.Client to it, but
+// you can also implement it yourself, for example to record requests, or to put godscache in front
+// of a fake or some other kind of store. Use NewClientWithStore to make a Client with your own
+// Store.
+type Store interface {
+	// Get loads the entity stored for key into dst, which must be a struct pointer.
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+
+	// GetMulti is a batch version of Get.
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+
+	// Put saves the entity src into the store for key, and returns the complete key.
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+
+	// PutMulti is a batch version of Put.
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+
+	// Delete deletes the entity for the given key.
+	Delete(ctx context.Context, key *datastore.Key) error
+
+	// DeleteMulti is a batch version of Delete.
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+
+	// AllocateIDs gives incomplete keys IDs, and returns them as complete keys, without
+	// saving any entities.
+	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
+
+	// Mutate applies the mutations atomically, and returns the keys of the entities they
+	// affected, in the same order. Incomplete keys are replaced with the keys they were given.
+	Mutate(ctx context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error)
+
+	// Run runs the given query.
+	Run(ctx context.Context, q *datastore.Query) Iterator
+
+	// NewTransaction starts a new transaction.
+	NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (Transaction, error)
+
+	// RunInTransaction runs f in a transaction, retrying it on contention, and commits the
+	// transaction if f returns nil.
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error)
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Iterator is the result of running a query. A *datastore.Iterator satisfies it.
+type Iterator interface {
+	// Next returns the key of the next result, and loads the result into dst unless the query
+	// is keys-only or dst is nil. When there are no more results, the error is iterator.Done.
+	Next(dst interface{}) (*datastore.Key, error)
+
+	// Cursor returns a cursor for the iterator's current location.
+	Cursor() (datastore.Cursor, error)
+}
+
+// Transaction is a datastore transaction. A *datastore.Transaction satisfies it.
+type Transaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+	PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error)
+	Delete(key *datastore.Key) error
+	DeleteMulti(keys []*datastore.Key) error
+	Commit() (*datastore.Commit, error)
+	Rollback() error
+}
+
+// datastoreStore adapts a Google Cloud Datastore client to the Store interface.
+type datastoreStore struct {
+	client *datastore.Client
+}
+
+// NewDatastoreStore returns a Store which uses the given Google Cloud Datastore client.
+func NewDatastoreStore(client *datastore.Client) Store {
+	return &datastoreStore{client: client}
+}
+
+func (s *datastoreStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return s.client.Get(ctx, key, dst)
+}
+
+func (s *datastoreStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return s.client.GetMulti(ctx, keys, dst)
+}
+
+func (s *datastoreStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return s.client.Put(ctx, key, src)
+}
+
+func (s *datastoreStore) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return s.client.PutMulti(ctx, keys, src)
+}
+
+func (s *datastoreStore) Delete(ctx context.Context, key *datastore.Key) error {
+	return s.client.Delete(ctx, key)
+}
+
+func (s *datastoreStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return s.client.DeleteMulti(ctx, keys)
+}
+
+func (s *datastoreStore) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return s.client.AllocateIDs(ctx, keys)
+}
+
+func (s *datastoreStore) Mutate(ctx context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error) {
+	return s.client.Mutate(ctx, muts...)
+}
+
+func (s *datastoreStore) Run(ctx context.Context, q *datastore.Query) Iterator {
+	return s.client.Run(ctx, q)
+}
+
+func (s *datastoreStore) NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (Transaction, error) {
+	tx, err := s.client.NewTransaction(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (s *datastoreStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return s.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(tx)
+	}, opts...)
+}
+
+func (s *datastoreStore) Close() error {
+	return s.client.Close()
+}
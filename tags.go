@@ -0,0 +1,298 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Values which aren't entities, such as data derived from several entities, can be cached with
+// SetTagged, under keys of their own, and with tags saying what they depend on. Each tag has a
+// version, which is kept in memcache, and each tagged value is cached with the versions of its
+// tags. Invalidating a tag deletes its version, so every value cached with it is ignored, until
+// it's cached again with the tag's new version.
+
+// The prefixes of the memcache keys of tag versions and tagged values.
+const (
+	tagKeyPrefix    = "godscache:tag:"
+	taggedKeyPrefix = "godscache:tagged:"
+)
+
+// taggedValue is a tagged value in the cache, with the versions of its tags.
+type taggedValue struct {
+	Tags  map[string]string `json:"t"`
+	Value json.RawMessage   `json:"v"`
+}
+
+// KeyTag returns the tag for the entity with the given key. Put, PutMulti, Delete and DeleteMulti
+// invalidate the tags of the entities they write, so values tagged with them are cached until
+// the entities change.
+func KeyTag(key *datastore.Key) string {
+	cached, _ := json.Marshal(keyToCache(key))
+	return "key:" + string(cached)
+}
+
+// hashedKey returns a memcache key with the given prefix for a string of any length or content.
+func hashedKey(prefix, s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// SetTagged caches value, which must be able to be encoded as JSON, under the given key, with the
+// given tags. It's ignored by GetTagged once any of its tags is invalidated. A tag which is
+// invalidated after the value's data was read, but before the value is set, doesn't apply to
+// it, so values should be set as soon as their data is read.
+func (c *Client) SetTagged(ctx context.Context, key string, value interface{}, tags ...string) error {
+	err := c.setTagged(ctx, key, value, 0, tags)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.SetTagged: %v", err)
+	}
+
+	return nil
+}
+
+// setTagged caches a tagged value, which expires after ttl, unless ttl is 0.
+func (c *Client) setTagged(ctx context.Context, key string, value interface{}, ttl time.Duration, tags []string) error {
+	if c.MemcacheClient == nil || cacheControlFrom(ctx).noCache {
+		return nil
+	}
+
+	versions, err := c.tagVersions(tags, true)
+	if err != nil {
+		return fmt.Errorf("failed getting tag versions: %v", err)
+	}
+
+	return c.setVersioned(key, value, ttl, versions)
+}
+
+// setVersioned caches a tagged value with the given versions of its tags, which expires after
+// ttl, unless ttl is 0. If any of the tags is invalidated after its version was got, the value
+// is ignored as soon as it's cached.
+func (c *Client) setVersioned(key string, value interface{}, ttl time.Duration, versions map[string]string) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed marshaling value to JSON: %v", err)
+	}
+
+	wrapped, err := json.Marshal(taggedValue{Tags: versions, Value: data})
+	if err != nil {
+		return fmt.Errorf("failed marshaling tagged value to JSON: %v", err)
+	}
+
+	itemKey := hashedKey(taggedKeyPrefix, key)
+
+	encoded, err := c.encodeValue(itemKey, reflect.TypeOf(value), wrapped)
+	if err != nil {
+		return fmt.Errorf("failed encoding value: %v", err)
+	}
+
+	items, err := c.cacheItems(itemKey, encoded)
+	if err != nil {
+		return fmt.Errorf("failed making cache items: %v", err)
+	}
+
+	for _, item := range items {
+		item.Expiration = expiration(ttl)
+
+		err = c.MemcacheClient.Set(item)
+		if err != nil {
+			return fmt.Errorf("failed adding item to cache: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// expiration returns the memcache expiration time for items which expire after ttl. It's
+// rounded up to whole seconds, and it's 0, meaning they don't expire, if ttl is 0 or less.
+func expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	seconds := (ttl + time.Second - 1) / time.Second
+
+	// Memcached takes expiration times of more than 30 days as Unix times.
+	if seconds > 30*24*60*60 {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	return int32(seconds)
+}
+
+// GetTagged gets the value cached under the given key by SetTagged into dst, which must be a
+// pointer to a value of the same type. It returns false if there's no value cached, if it was
+// cached from a different type, or if any of its tags was invalidated since it was cached.
+func (c *Client) GetTagged(ctx context.Context, key string, dst interface{}) (bool, error) {
+	if c.MemcacheClient == nil || !cacheControlFrom(ctx).readsCache() {
+		return false, nil
+	}
+
+	if reflect.ValueOf(dst).Kind() != reflect.Ptr {
+		return false, fmt.Errorf("godscache.Client.GetTagged: dst must be a pointer")
+	}
+
+	itemKey := hashedKey(taggedKeyPrefix, key)
+
+	item, err := c.MemcacheClient.Get(itemKey)
+	if err == memcache.ErrCacheMiss {
+		c.stats.misses.Add(1)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("godscache.Client.GetTagged: failed getting data from memcached: %v", err)
+	}
+
+	values, err := c.resolveChunks(map[string]*memcache.Item{itemKey: item})
+	if err != nil {
+		return false, fmt.Errorf("godscache.Client.GetTagged: failed getting data chunks from memcached: %v", err)
+	}
+
+	value, ok := values[itemKey]
+	if !ok {
+		c.stats.misses.Add(1)
+		return false, nil
+	}
+
+	// Values which can't be decoded are replaced the next time they're set.
+	e, err := c.decodeValue(itemKey, reflect.TypeOf(dst), value)
+	if err != nil {
+		c.stats.misses.Add(1)
+		return false, nil
+	}
+
+	var tv taggedValue
+	err = json.Unmarshal(e.data, &tv)
+	if err != nil {
+		c.stats.misses.Add(1)
+		return false, nil
+	}
+
+	tags := make([]string, 0, len(tv.Tags))
+	for tag := range tv.Tags {
+		tags = append(tags, tag)
+	}
+
+	versions, err := c.tagVersions(tags, false)
+	if err != nil {
+		return false, fmt.Errorf("godscache.Client.GetTagged: failed getting tag versions: %v", err)
+	}
+
+	for tag, version := range tv.Tags {
+		if versions[tag] != version {
+			c.stats.misses.Add(1)
+			return false, nil
+		}
+	}
+
+	err = json.Unmarshal(tv.Value, dst)
+	if err != nil {
+		c.stats.misses.Add(1)
+		return false, nil
+	}
+
+	c.stats.hits.Add(1)
+
+	return true, nil
+}
+
+// InvalidateTags makes GetTagged ignore every value cached with any of the given tags.
+func (c *Client) InvalidateTags(ctx context.Context, tags ...string) error {
+	if c.MemcacheClient == nil {
+		return nil
+	}
+
+	for _, tag := range tags {
+		err := c.MemcacheClient.Delete(hashedKey(tagKeyPrefix, tag))
+		if err != nil && err != memcache.ErrCacheMiss {
+			return fmt.Errorf("godscache.Client.InvalidateTags: failed deleting tag version from memcached: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// invalidateKeyTags invalidates the tags of the entities with the given keys. The tags' versions
+// are got with one request to memcache, and only the tags which have one are invalidated, so
+// writing entities which no values are tagged with doesn't cost a request for each of them.
+func (c *Client) invalidateKeyTags(ctx context.Context, keys []*datastore.Key) error {
+	if c.MemcacheClient == nil || len(keys) == 0 {
+		return nil
+	}
+
+	tags := make([]string, 0, len(keys))
+	for _, key := range keys {
+		tags = append(tags, KeyTag(key))
+	}
+
+	versions, err := c.tagVersions(tags, false)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.invalidateKeyTags: failed getting tag versions: %v", err)
+	}
+
+	versioned := make([]string, 0, len(versions))
+	for tag := range versions {
+		versioned = append(versioned, tag)
+	}
+
+	return c.InvalidateTags(ctx, versioned...)
+}
+
+// tagVersions returns the current versions of the given tags. Tags which don't have a version
+// are left out, unless create is true, in which case they're given one.
+func (c *Client) tagVersions(tags []string, create bool) (map[string]string, error) {
+	versions := make(map[string]string, len(tags))
+	if len(tags) == 0 {
+		return versions, nil
+	}
+
+	itemKeys := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		itemKeys = append(itemKeys, hashedKey(tagKeyPrefix, tag))
+	}
+
+	items, err := c.MemcacheClient.GetMulti(itemKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, tag := range tags {
+		if item, ok := items[itemKeys[idx]]; ok {
+			versions[tag] = string(item.Value)
+			continue
+		}
+
+		if !create {
+			continue
+		}
+
+		// Another client may be giving the tag a version at the same time, in which case
+		// whichever is added first is used.
+		version := randomID()
+
+		err = c.MemcacheClient.Add(&memcache.Item{Key: itemKeys[idx], Value: []byte(version)})
+		if err == memcache.ErrNotStored {
+			item, err := c.MemcacheClient.Get(itemKeys[idx])
+			if err != nil {
+				return nil, err
+			}
+			version = string(item.Value)
+		} else if err != nil {
+			return nil, err
+		}
+
+		versions[tag] = version
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// DefaultTombstoneTTL is how long NewClient keeps tombstones for deleted entities in the cache.
+const DefaultTombstoneTTL = 30 * time.Second
+
+// flagTombstone marks a tombstone, which is cached in place of an entity while it's being
+// deleted, and for a while afterwards. Reads which find one report that the entity doesn't
+// exist, and reads which missed the cache can't replace it with what they read from the
+// datastore before the delete. Tombstones have no payload, and aren't encrypted.
+const flagTombstone = 1 << 4
+
+// tombstoneValue is the cached value of a tombstone.
+var tombstoneValue = []byte{valueMagic, flagTombstone}
+
+// isTombstone says whether a cached value is a tombstone.
+func isTombstone(value []byte) bool {
+	return bytes.Equal(value, tombstoneValue)
+}
+
+// storeMode says how addToCache stores an item under a key which may already be cached.
+type storeMode int
+
+const (
+	// storeSet always stores the item. It's for writes, which replace tombstones too.
+	storeSet storeMode = iota
+
+	// storeAdd only stores the item if nothing usable is cached under its key. What's cached is
+	// replaced if it can't be used, such as when it was cached from another version of the
+	// entity's type, unless it's a tombstone, or it changes while it's being replaced.
+	storeAdd
+
+	// storeReplace stores the item unless a tombstone is cached under its key, or what's cached
+	// under its key changes while it's being stored.
+	storeReplace
+)
+
+// storeItem stores an item in the cache according to mode. The item holds an entity of type t.
+// It returns true if the item was stored.
+func (c *Client) storeItem(item *memcache.Item, t reflect.Type, mode storeMode) (bool, error) {
+	if mode == storeSet {
+		return true, c.MemcacheClient.Set(item)
+	}
+
+	err := c.MemcacheClient.Add(item)
+	if err != memcache.ErrNotStored {
+		return err == nil, err
+	}
+
+	// Something is cached under the key already. Replace it, unless it's a tombstone, or it
+	// changes before it's replaced, in which case whatever changed it wins.
+	prev, err := c.MemcacheClient.Get(item.Key)
+	if err == memcache.ErrCacheMiss {
+		err = c.MemcacheClient.Add(item)
+		if err == memcache.ErrNotStored {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if isTombstone(prev.Value) {
+		return false, nil
+	}
+
+	if mode == storeAdd && c.usableItem(prev, t) {
+		return false, nil
+	}
+
+	prev.Value = item.Value
+	prev.Flags = item.Flags
+	prev.Expiration = item.Expiration
+
+	err = c.MemcacheClient.CompareAndSwap(prev)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// usableItem says whether a cached item could be read as an entity of type t. Items which were
+// cached from another type, or from another version of t, or whose chunks are missing, can't be.
+// If it can't be told, the item is assumed to be usable.
+func (c *Client) usableItem(item *memcache.Item, t reflect.Type) bool {
+	values, err := c.resolveChunks(map[string]*memcache.Item{item.Key: item})
+	if err != nil {
+		return true
+	}
+
+	value, ok := values[item.Key]
+	if !ok {
+		return false
+	}
+
+	_, err = c.decodeValue(item.Key, t, value)
+
+	return !errors.Is(err, errSchemaMismatch)
+}
+
+// tombstoneCache caches tombstones for keys, in place of their entities. If the client's
+// TombstoneTTL is 0 or less, the entities are deleted from the cache instead.
+func (c *Client) tombstoneCache(keys []*datastore.Key) error {
+	if c.MemcacheClient == nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		if c.TombstoneTTL <= 0 {
+			err := c.deleteFromCache(key)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := c.MemcacheClient.Set(&memcache.Item{
+			Key:        cacheKey(key),
+			Value:      tombstoneValue,
+			Expiration: expiration(c.TombstoneTTL),
+		})
+		if err != nil {
+			return fmt.Errorf("godscache.Client.tombstoneCache: failed caching tombstone: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// replaceWithTombstone caches a tombstone for key in place of its entity, after the entity was
+// found to be missing from the datastore. A tombstone which is already cached is kept, since it
+// may have been cached by a delete which hasn't finished yet, and whatever is cached under key
+// while the tombstone is being stored wins. If the client's TombstoneTTL is 0 or less, the
+// entity is deleted from the cache instead.
+func (c *Client) replaceWithTombstone(key *datastore.Key) error {
+	if c.MemcacheClient == nil {
+		return nil
+	}
+
+	if c.TombstoneTTL <= 0 {
+		return c.deleteFromCache(key)
+	}
+
+	_, err := c.storeItem(&memcache.Item{
+		Key:        cacheKey(key),
+		Value:      tombstoneValue,
+		Expiration: expiration(c.TombstoneTTL),
+	}, nil, storeReplace)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.replaceWithTombstone: failed caching tombstone: %v", err)
+	}
+
+	return nil
+}
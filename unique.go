@@ -0,0 +1,457 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Fields which must be unique among the entities of a kind, such as a user's email address, can
+// be registered with SetUniqueIndex. Each value of a unique field is owned by the entity which
+// has it, which is recorded in a marker entity of kind UniqueMarkerKind, named after the kind,
+// the field and the value, in the entity's namespace. Put, PutMulti, Delete and DeleteMulti
+// write the markers in the same transaction as the entities, so two entities can't own the same
+// value, and GetBy finds an entity by getting its marker, then the entity, through the cache.
+
+// UniqueMarkerKind is the kind of the marker entities which record which entity owns each value
+// of a unique field.
+const UniqueMarkerKind = "GodscacheUnique"
+
+// ErrNotUnique is returned by Put and PutMulti, wrapped in another error, when an entity has the
+// value of a unique field which another entity already owns.
+var ErrNotUnique = errors.New("godscache: the value of a unique field belongs to another entity")
+
+// uniqueMarker is a marker entity, recording which entity owns a value of a unique field.
+type uniqueMarker struct {
+	Owner *datastore.Key `datastore:",noindex"`
+}
+
+// uniqueChanges are the markers a write added and removed, which must be updated in the cache
+// once it succeeds.
+type uniqueChanges struct {
+	added   []*datastore.Key
+	owners  []*datastore.Key
+	removed []*datastore.Key
+}
+
+// SetUniqueIndex makes field unique among the entities of the given kind, so that no two of them
+// can have the same value for it, and so they can be got by its value with GetBy. The field is
+// the name of a datastore property, which may have been renamed with a struct tag. Entities
+// which don't have the property, or which have its zero value, don't own any value. It's safe to
+// call while the client is in use, but entities which were written before it was called don't
+// own their values until they're written again.
+func (c *Client) SetUniqueIndex(kind, field string) {
+	c.uniqueMu.Lock()
+	defer c.uniqueMu.Unlock()
+
+	for _, f := range c.uniqueIndexes[kind] {
+		if f == field {
+			return
+		}
+	}
+
+	if c.uniqueIndexes == nil {
+		c.uniqueIndexes = make(map[string][]string)
+	}
+
+	// The fields are copied, so the ones uniqueFields returned are never changed.
+	fields := make([]string, 0, len(c.uniqueIndexes[kind])+1)
+	fields = append(fields, c.uniqueIndexes[kind]...)
+	c.uniqueIndexes[kind] = append(fields, field)
+}
+
+// uniqueFields returns the unique fields registered for a kind.
+func (c *Client) uniqueFields(kind string) []string {
+	c.uniqueMu.RLock()
+	defer c.uniqueMu.RUnlock()
+
+	return c.uniqueIndexes[kind]
+}
+
+// hasUniqueFields reports whether any of the keys is of a kind with unique fields.
+func (c *Client) hasUniqueFields(keys []*datastore.Key) bool {
+	for _, key := range keys {
+		if key != nil && len(c.uniqueFields(key.Kind)) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uniqueMarkerKey returns the key of the marker for a value of a unique field. The kind and
+// field are prefixed with their lengths in the marker's name, so that no two kinds, fields and
+// values have the same name, whatever they contain, and the value is hashed, so that the name is
+// short enough to be cached, and has nothing in it that memcache doesn't allow.
+func uniqueMarkerKey(namespace, kind, field string, value interface{}) *datastore.Key {
+	sum := sha256.Sum256([]byte(uniqueValue(value)))
+
+	key := datastore.NameKey(UniqueMarkerKind, fmt.Sprintf("%d:%s%d:%s%x", len(kind), kind, len(field), field, sum), nil)
+	key.Namespace = namespace
+
+	return key
+}
+
+// uniqueValue encodes a value of a unique field, tagged with its type, the way the datastore
+// stores it, so that values of different types never have the same encoding, but a value has
+// the same one whether it's being saved, or was loaded from the datastore, or was passed to
+// GetBy as any integer or float type.
+func uniqueValue(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return "bytes:" + string(v)
+	case time.Time:
+		return "time:" + v.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+	case *datastore.Key:
+		return "key:" + v.Encode()
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String:
+		return "string:" + v.String()
+	case reflect.Bool:
+		return "bool:" + strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int:" + strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int:" + strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return "float:" + strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+// uniqueMarkerKeys returns the keys of the markers for the values of the unique fields in the
+// properties of the entity with the given key.
+func (c *Client) uniqueMarkerKeys(key *datastore.Key, props []datastore.Property) []*datastore.Key {
+	var markers []*datastore.Key
+
+	for _, field := range c.uniqueFields(key.Kind) {
+		for _, prop := range props {
+			if prop.Name != field || prop.Value == nil || reflect.ValueOf(prop.Value).IsZero() {
+				continue
+			}
+
+			markers = append(markers, uniqueMarkerKey(key.Namespace, key.Kind, field, prop.Value))
+		}
+	}
+
+	return markers
+}
+
+// entityProperties returns the datastore properties of an entity, which can be a struct or a
+// pointer to one, a datastore.PropertyList, or a datastore.PropertyLoadSaver.
+func entityProperties(src interface{}) ([]datastore.Property, error) {
+	props, ok, err := saveProperties(src)
+	if ok || err != nil {
+		return props, err
+	}
+
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Ptr {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		src = p.Interface()
+	}
+
+	return datastore.SaveStruct(src)
+}
+
+// txGetMulti gets the entities for keys in a transaction into dst, and reports which of them
+// were found.
+func txGetMulti(tx Transaction, keys []*datastore.Key, dst interface{}) ([]bool, error) {
+	found := make([]bool, len(keys))
+
+	err := tx.GetMulti(keys, dst)
+	merr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+
+	for idx := range keys {
+		if isMulti && merr[idx] != nil {
+			if merr[idx] != datastore.ErrNoSuchEntity {
+				return nil, merr[idx]
+			}
+			continue
+		}
+
+		found[idx] = true
+	}
+
+	return found, nil
+}
+
+// putUnique puts entities into the datastore in a transaction, along with the markers for the
+// values of their unique fields, and deletes the markers for the values they no longer have.
+// It returns the complete keys, and the markers it changed. Each element of srcs must be a
+// valid src for Transaction.Put.
+func (c *Client) putUnique(ctx context.Context, keys []*datastore.Key, srcs []interface{}) ([]*datastore.Key, uniqueChanges, error) {
+	var changes uniqueChanges
+
+	// Incomplete keys are given IDs first, since the markers must say which entities own them.
+	keys = append([]*datastore.Key(nil), keys...)
+
+	var incomplete []*datastore.Key
+	var incompleteIdxs []int
+	for idx, key := range keys {
+		if key.Incomplete() {
+			incomplete = append(incomplete, key)
+			incompleteIdxs = append(incompleteIdxs, idx)
+		}
+	}
+
+	if len(incomplete) > 0 {
+		allocated, err := c.Store.AllocateIDs(ctx, incomplete)
+		if err != nil {
+			return nil, changes, fmt.Errorf("failed allocating IDs: %v", err)
+		}
+
+		for idx, keyIdx := range incompleteIdxs {
+			keys[keyIdx] = allocated[idx]
+		}
+	}
+
+	_, err := c.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		var err error
+		changes, err = c.putInTransaction(tx, keys, srcs)
+		return err
+	})
+	if err != nil {
+		return nil, uniqueChanges{}, err
+	}
+
+	return keys, changes, nil
+}
+
+// putInTransaction puts entities with complete keys in a transaction, along with the markers
+// for the values of their unique fields, and deletes the markers for the values they no longer
+// have. It returns the markers it changed. Each element of srcs must be a valid src for
+// Transaction.Put.
+func (c *Client) putInTransaction(tx Transaction, keys []*datastore.Key, srcs []interface{}) (uniqueChanges, error) {
+	var changes uniqueChanges
+
+	newMarkers := make([][]*datastore.Key, len(keys))
+	for idx, key := range keys {
+		props, err := entityProperties(srcs[idx])
+		if err != nil {
+			return uniqueChanges{}, fmt.Errorf("failed getting properties: %v", err)
+		}
+
+		newMarkers[idx] = c.uniqueMarkerKeys(key, props)
+	}
+
+	old := make([]datastore.PropertyList, len(keys))
+	found, err := txGetMulti(tx, keys, old)
+	if err != nil {
+		return uniqueChanges{}, fmt.Errorf("failed getting entities: %v", err)
+	}
+
+	// A marker which one entity in the batch gives up can be taken by another one.
+	added := make(map[string]bool)
+	removed := make(map[string]*datastore.Key)
+
+	for idx, key := range keys {
+		var oldMarkers []*datastore.Key
+		if found[idx] {
+			oldMarkers = c.uniqueMarkerKeys(key, old[idx])
+		}
+
+		kept := make(map[string]bool, len(newMarkers[idx]))
+		for _, marker := range newMarkers[idx] {
+			kept[marker.String()] = true
+		}
+
+		for _, marker := range oldMarkers {
+			if !kept[marker.String()] {
+				removed[marker.String()] = marker
+			}
+		}
+
+		owned := make(map[string]bool, len(oldMarkers))
+		for _, marker := range oldMarkers {
+			owned[marker.String()] = true
+		}
+
+		for _, marker := range newMarkers[idx] {
+			markerStr := marker.String()
+			if owned[markerStr] {
+				continue
+			}
+
+			if added[markerStr] {
+				return uniqueChanges{}, fmt.Errorf("%w: %v", ErrNotUnique, marker.Name)
+			}
+			added[markerStr] = true
+
+			changes.added = append(changes.added, marker)
+			changes.owners = append(changes.owners, key)
+		}
+	}
+
+	markers := make([]uniqueMarker, len(changes.added))
+	found, err = txGetMulti(tx, changes.added, markers)
+	if err != nil {
+		return uniqueChanges{}, fmt.Errorf("failed getting unique markers: %v", err)
+	}
+
+	for idx, marker := range changes.added {
+		_, released := removed[marker.String()]
+		if found[idx] && !released && !markers[idx].Owner.Equal(changes.owners[idx]) {
+			return uniqueChanges{}, fmt.Errorf("%w: %v", ErrNotUnique, marker.Name)
+		}
+
+		markers[idx].Owner = changes.owners[idx]
+		delete(removed, marker.String())
+	}
+
+	for _, marker := range removed {
+		changes.removed = append(changes.removed, marker)
+	}
+
+	if len(changes.added) > 0 {
+		_, err = tx.PutMulti(changes.added, markers)
+		if err != nil {
+			return uniqueChanges{}, fmt.Errorf("failed putting unique markers: %v", err)
+		}
+	}
+
+	if len(changes.removed) > 0 {
+		err = tx.DeleteMulti(changes.removed)
+		if err != nil {
+			return uniqueChanges{}, fmt.Errorf("failed deleting unique markers: %v", err)
+		}
+	}
+
+	for idx, key := range keys {
+		_, err = tx.Put(key, srcs[idx])
+		if err != nil {
+			return uniqueChanges{}, fmt.Errorf("failed putting entity: %v", err)
+		}
+	}
+
+	return changes, nil
+}
+
+// deleteUnique deletes entities from the datastore in a transaction, along with the markers for
+// the values of their unique fields. It returns the markers it deleted.
+func (c *Client) deleteUnique(ctx context.Context, keys []*datastore.Key) (uniqueChanges, error) {
+	var changes uniqueChanges
+
+	_, err := c.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		changes = uniqueChanges{}
+
+		old := make([]datastore.PropertyList, len(keys))
+		found, err := txGetMulti(tx, keys, old)
+		if err != nil {
+			return fmt.Errorf("failed getting entities: %v", err)
+		}
+
+		for idx, key := range keys {
+			if found[idx] {
+				changes.removed = append(changes.removed, c.uniqueMarkerKeys(key, old[idx])...)
+			}
+		}
+
+		deleted := make([]*datastore.Key, 0, len(changes.removed)+len(keys))
+		deleted = append(deleted, changes.removed...)
+		deleted = append(deleted, keys...)
+
+		return tx.DeleteMulti(deleted)
+	})
+	if err != nil {
+		return uniqueChanges{}, err
+	}
+
+	return changes, nil
+}
+
+// cacheUniqueChanges updates the cache after the markers for the values of unique fields were
+// changed, caching the added ones, and tombstones for the removed ones. The write they were
+// changed by has already succeeded by then, so it does its best: markers which can't be cached
+// are deleted from the cache instead, and failures to do that are only logged, the same as for
+// any other entry which is left out of date.
+func (c *Client) cacheUniqueChanges(ctx context.Context, changes uniqueChanges) {
+	var uncached []*datastore.Key
+
+	for idx, marker := range changes.added {
+		err := c.writeCache(ctx, marker, &uniqueMarker{Owner: changes.owners[idx]})
+		if err != nil {
+			log.Printf("godscache.Client.cacheUniqueChanges: failed caching unique marker %v: %v", marker, err)
+			uncached = append(uncached, marker)
+		}
+	}
+
+	c.deleteFromMemory(ctx, uncached, false)
+
+	err := c.tombstoneCache(changes.removed)
+	if err != nil {
+		log.Printf("godscache.Client.cacheUniqueChanges: failed caching tombstones for unique markers: %v", err)
+		uncached = append(uncached, changes.removed...)
+	}
+	c.deleteFromMemory(ctx, changes.removed, true)
+
+	for _, marker := range uncached {
+		err := c.deleteFromCache(marker)
+		if err != nil {
+			log.Printf("godscache.Client.cacheUniqueChanges: failed deleting unique marker %v from cache: %v", marker, err)
+		}
+	}
+
+	changed := append(append([]*datastore.Key(nil), changes.added...), changes.removed...)
+
+	c.publishInvalidation(ctx, changed)
+
+	err = c.invalidateKeyTags(ctx, changed)
+	if err != nil {
+		log.Printf("godscache.Client.cacheUniqueChanges: failed invalidating tags of unique markers: %v", err)
+	}
+}
+
+// GetBy gets the entity of the given kind in the default namespace whose unique field, which
+// must have been registered with SetUniqueIndex, has the given value, into dst, the same way as
+// Get. It returns datastore.ErrNoSuchEntity if no entity has the value. The entity is found
+// through its marker, which is cached like any other entity, so unlike a query, it's strongly
+// consistent, and it usually doesn't reach the datastore.
+func (c *Client) GetBy(ctx context.Context, kind, field string, value interface{}, dst interface{}) error {
+	return c.GetByNamespace(ctx, "", kind, field, value, dst)
+}
+
+// GetByNamespace is like GetBy, for entities in the given namespace.
+func (c *Client) GetByNamespace(ctx context.Context, namespace, kind, field string, value interface{}, dst interface{}) error {
+	unique := false
+	for _, f := range c.uniqueFields(kind) {
+		if f == field {
+			unique = true
+		}
+	}
+
+	if !unique {
+		return fmt.Errorf("godscache.Client.GetBy: %v isn't a unique field of %v", field, kind)
+	}
+
+	var marker uniqueMarker
+
+	err := c.Get(ctx, uniqueMarkerKey(namespace, kind, field, value), &marker)
+	if err != nil {
+		return err
+	}
+
+	if marker.Owner == nil {
+		return datastore.ErrNoSuchEntity
+	}
+
+	return c.Get(ctx, marker.Owner, dst)
+}
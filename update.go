@@ -0,0 +1,166 @@
+// Copyright 2018 Jeremy Carter <Jeremy@JeremyCarter.ca>
+// This file may only be used in accordance with the license in the LICENSE file in this directory.
+
+package godscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrVersionConflict is returned by Update, wrapped in another error, when the entity's version
+// field doesn't have the version dst had when Update was called, because the entity was written
+// since that version was read.
+var ErrVersionConflict = errors.New("godscache: the entity was written since its version was read")
+
+// versionField returns dst's version field, which is the integer field tagged with
+// `godscache:"version"`, if dst is a pointer to a struct which has one.
+func versionField(dst interface{}) (reflect.Value, bool, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, false, nil
+	}
+	v = v.Elem()
+
+	t := v.Type()
+
+	for idx := 0; idx < t.NumField(); idx++ {
+		if _, ok := tagOption(t.Field(idx), "version"); !ok {
+			continue
+		}
+
+		field := v.Field(idx)
+
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		default:
+			return reflect.Value{}, false, fmt.Errorf("%v.%v must be a signed integer to be a version field", t, t.Field(idx).Name)
+		}
+
+		if !field.CanSet() {
+			return reflect.Value{}, false, fmt.Errorf("%v.%v must be exported to be a version field", t, t.Field(idx).Name)
+		}
+
+		return field, true, nil
+	}
+
+	return reflect.Value{}, false, nil
+}
+
+// Update gets the entity for key into dst in a datastore transaction, calls f to change it, then
+// puts it, and removes the entity from the cache once the transaction is committed, so that it's
+// read from the datastore again. It isn't written to the cache, since concurrent Updates of the
+// same entity may write it in a different order than they committed it. The dst value must be a
+// pointer to a struct, a datastore.PropertyList, or a datastore.PropertyLoadSaver, and it's set
+// to its zero value before the entity is got into it. If the transaction fails because the
+// entity was written concurrently, the whole thing is retried, so f may be called more than
+// once, and it should change nothing but dst. It's retried as many times as the datastore's
+// RunInTransaction retries, unless opts say otherwise, such as with datastore.MaxAttempts. If f
+// returns an error, nothing is put, and the error is returned as it is. If Update fails, dst may
+// have been changed.
+//
+// If dst is a struct with an integer field tagged with `godscache:"version"`, the field is
+// incremented by every Update. If it isn't 0 when Update is called, it's the version of the
+// entity the caller read, such as when it was shown to a user to edit, and if the entity's
+// version is different, an error wrapping ErrVersionConflict is returned, rather than writing
+// over changes the caller hasn't seen.
+func (c *Client) Update(ctx context.Context, key *datastore.Key, dst interface{}, f func() error, opts ...datastore.TransactionOption) error {
+	if cacheControlFrom(ctx).cacheOnly {
+		return errors.New("godscache.Client.Update: writes can't be made with WithCacheOnly")
+	}
+
+	if key == nil || key.Incomplete() {
+		return errors.New("godscache.Client.Update: key must be complete")
+	}
+
+	dVal := reflect.ValueOf(dst)
+	if dVal.Kind() != reflect.Ptr || dVal.IsNil() {
+		return errors.New("godscache.Client.Update: dst must be a non-nil pointer")
+	}
+
+	version, hasVersion, err := versionField(dst)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.Update: %v", err)
+	}
+
+	// The version the caller read, if there is one, is checked by every attempt.
+	var wanted int64
+	if hasVersion {
+		wanted = version.Int()
+	}
+
+	var fErr error
+	var changes uniqueChanges
+
+	_, err = c.Store.RunInTransaction(ctx, func(tx Transaction) error {
+		// Every attempt gets the entity into a zero value, since the datastore loads entities on
+		// top of what dst holds, and appends to a datastore.PropertyList. Entities written
+		// before they had a version load a version of 0.
+		dVal.Elem().Set(reflect.Zero(dVal.Elem().Type()))
+
+		err := tx.Get(key, dst)
+		if err != nil {
+			return fmt.Errorf("failed getting entity: %w", err)
+		}
+
+		// The version is incremented after f is called, so f can't change it.
+		var current int64
+		if hasVersion {
+			current = version.Int()
+			if wanted != 0 && current != wanted {
+				return fmt.Errorf("%w: it's at version %v, not %v", ErrVersionConflict, current, wanted)
+			}
+		}
+
+		fErr = f()
+		if fErr != nil {
+			return fErr
+		}
+
+		if hasVersion {
+			version.SetInt(current + 1)
+		}
+
+		// Entities with unique fields are put along with the markers for their values.
+		if c.hasUniqueFields([]*datastore.Key{key}) {
+			changes, err = c.putInTransaction(tx, []*datastore.Key{key}, []interface{}{dst})
+		} else {
+			_, err = tx.Put(key, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("failed putting entity: %w", err)
+		}
+
+		return nil
+	}, opts...)
+
+	if fErr != nil && err == fErr {
+		return fErr
+	}
+	if err != nil {
+		return fmt.Errorf("godscache.Client.Update: %w", err)
+	}
+
+	// Invalidate the cached entity, so the committed one is read from the datastore.
+	c.deleteFromMemory(ctx, []*datastore.Key{key}, false)
+
+	err = c.deleteFromCache(key)
+	if err != nil {
+		return fmt.Errorf("godscache.Client.Update: failed deleting item from cache: %v", err)
+	}
+
+	c.cacheUniqueChanges(ctx, changes)
+
+	c.publishInvalidation(ctx, []*datastore.Key{key})
+
+	err = c.invalidateKeyTags(ctx, []*datastore.Key{key})
+	if err != nil {
+		return fmt.Errorf("godscache.Client.Update: failed invalidating tags: %v", err)
+	}
+
+	return nil
+}